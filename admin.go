@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+
+	"github.com/zhsj/wghttp/internal/limit"
+	"github.com/zhsj/wghttp/internal/proxy"
+)
+
+// handshakeHealthy is how old the last handshake may be before the tunnel is
+// reported unhealthy. WireGuard rejects a session after 180 seconds.
+const handshakeHealthy = 180 * time.Second
+
+type admin struct {
+	dev   *device.Device
+	peer  *peer
+	proxy *proxy.Proxy
+}
+
+func adminListener(addr string) (net.Listener, error) {
+	network := "tcp"
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr || strings.HasPrefix(addr, "/") {
+		network, addr = "unix", path
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0o600); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("chmod socket: %w", err)
+		}
+	}
+	logger.Verbosef("Admin listening on %s", ln.Addr())
+	return ln, nil
+}
+
+// removeStaleSocket removes the Unix socket left at path by a previous run.
+// Anything else at path is kept, and an error is returned for it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", a.handleStats)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	mux.HandleFunc("/health", a.handleHealth)
+	mux.HandleFunc("/control/resolve", a.handleResolve)
+	mux.HandleFunc("/control/rate", a.handleRate)
+	mux.HandleFunc("/accounting", a.handleAccounting)
+	return a.auth(mux)
+}
+
+func (a *admin) auth(next http.Handler) http.Handler {
+	if opts.AdminToken == "" {
+		return next
+	}
+	want := []byte("Bearer " + string(opts.AdminToken))
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (a *admin) handleStats(rw http.ResponseWriter, r *http.Request) {
+	s, err := proxyStats(a.dev, a.peer, a.proxy)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, _ := json.MarshalIndent(s, "", "  ")
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(append(resp, '\n'))
+}
+
+func (a *admin) handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	s, err := proxyStats(a.dev, a.peer, a.proxy)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(rw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("wghttp_last_handshake_timestamp_seconds", "gauge", "Unix time of the last WireGuard handshake.", s.LastHandshakeTimestamp)
+	metric("wghttp_received_bytes_total", "counter", "Bytes received from the WireGuard peer.", s.ReceivedBytes)
+	metric("wghttp_sent_bytes_total", "counter", "Bytes sent to the WireGuard peer.", s.SentBytes)
+	metric("wghttp_watchdog_recoveries_total", "counter", "Times the handshake watchdog recovered the tunnel.", s.WatchdogRecoveries)
+	metric("wghttp_active_connections", "gauge", "Proxy connections being served.", s.ActiveConnections)
+	metric("wghttp_connections_total", "counter", "Proxy connections accepted.", s.TotalConnections)
+	metric("wghttp_dns_lookups_total", "counter", "DNS lookups through --dns.", s.DNSLookups)
+	metric("wghttp_dns_failures_total", "counter", "Failed DNS lookups through --dns.", s.DNSFailures)
+	fmt.Fprintf(rw, "# HELP wghttp_rejected_connections_total Proxy connections refused by limits.\n# TYPE wghttp_rejected_connections_total counter\n")
+	fmt.Fprintf(rw, "wghttp_rejected_connections_total{limit=\"global\"} %d\n", s.RejectedByGlobalLimit)
+	fmt.Fprintf(rw, "wghttp_rejected_connections_total{limit=\"client\"} %d\n", s.RejectedByClientLimit)
+	metric("wghttp_throttling", "gauge", "Proxy reads and writes being delayed by bandwidth limits.", s.Throttling)
+	metric("wghttp_throttle_waits_total", "counter", "Proxy reads and writes delayed by bandwidth limits.", s.ThrottleWaits)
+	metric("wghttp_goroutines", "gauge", "Number of goroutines.", s.NumGoroutine)
+	fmt.Fprintf(rw, "# HELP wghttp_build_info Build information.\n# TYPE wghttp_build_info gauge\nwghttp_build_info{version=%q} 1\n", s.Version)
+}
+
+func (a *admin) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	s, err := proxyStats(a.dev, a.peer, a.proxy)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	age := time.Since(time.Unix(s.LastHandshakeTimestamp, 0))
+	if s.LastHandshakeTimestamp == 0 || age > handshakeHealthy {
+		http.Error(rw, "handshake is stale", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(rw, "ok, last handshake %s ago\n", age.Truncate(time.Second))
+}
+
+func (a *admin) handleResolve(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.peer.resolve() {
+		http.Error(rw, "peer endpoint is an IP address", http.StatusConflict)
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (a *admin) handleRate(rw http.ResponseWriter, r *http.Request) {
+	shaper := a.proxy.Shaper
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// Fields not in the request are kept.
+		cfg := shaper.Config()
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		shaper.SetConfig(cfg)
+		logger.Verbosef("Bandwidth is changed to %+v", cfg)
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp, _ := json.MarshalIndent(shaper.Config(), "", "  ")
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(append(resp, '\n'))
+}
+
+func (a *admin) handleAccounting(rw http.ResponseWriter, r *http.Request) {
+	account := a.proxy.Accounting
+	if account == nil {
+		http.Error(rw, "accounting is not enabled", http.StatusNotFound)
+		return
+	}
+	// A month like 2006-01 or a day like 2006-01-02.
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = time.Now().Format("2006-01")
+	}
+	resp, _ := json.MarshalIndent(struct {
+		Period  string
+		Quota   int64
+		Clients map[string]limit.Usage
+	}{period, account.Quota, account.Report(period)}, "", "  ")
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(append(resp, '\n'))
+}
+
+func serveAdmin(dev *device.Device, peer *peer, proxier *proxy.Proxy) error {
+	ln, err := adminListener(opts.AdminListen)
+	if err != nil {
+		return fmt.Errorf("create admin listener: %w", err)
+	}
+	a := &admin{dev: dev, peer: peer, proxy: proxier}
+	srv := &http.Server{Handler: a.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			logger.Errorf("Serve admin: %v", err)
+		}
+	}()
+	return nil
+}
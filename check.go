@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/zhsj/wghttp/internal/resolver"
+)
+
+type checkCommand struct {
+	Timeout timeT  `long:"timeout" default:"10s" description:"Time to wait for the handshake and each test"`
+	Query   string `long:"query" default:"example.com" description:"Domain to resolve through --dns"`
+	Target  string `long:"target" description:"Address to dial through the tunnel (optional, format: host:port)"`
+
+	failed bool
+}
+
+func (c *checkCommand) report(name string, err error, detail string) bool {
+	if err != nil {
+		c.failed = true
+		fmt.Printf("FAIL  %s: %v\n", name, err)
+		return false
+	}
+	if detail != "" {
+		fmt.Printf("PASS  %s: %s\n", name, detail)
+	} else {
+		fmt.Printf("PASS  %s\n", name)
+	}
+	return true
+}
+
+func (c *checkCommand) skip(name, reason string) {
+	fmt.Printf("SKIP  %s: %s\n", name, reason)
+}
+
+func (c *checkCommand) Execute(args []string) error {
+	timeout := time.Duration(c.Timeout) * time.Second
+
+	c.report("private key", checkKey(keyT(opts.PrivateKey)), "")
+	c.report("peer key", checkKey(opts.PeerKey), "")
+	if opts.PresharedKey != "" {
+		c.report("preshared key", checkKey(keyT(opts.PresharedKey)), "")
+	}
+
+	has4, has6 := false, false
+	for _, ip := range opts.ClientIPs {
+		has4 = has4 || netip.Addr(ip).Is4()
+		has6 = has6 || netip.Addr(ip).Is6()
+	}
+	c.report("client ip", checkClientIPs(), fmt.Sprintf("%v", opts.ClientIPs))
+	c.report("mtu", checkMTU(has6), fmt.Sprintf("%d", opts.MTU))
+	if ip, ok := dnsServerIP(opts.DNS); ok {
+		c.report("dns family", checkFamily(ip, has4, has6), ip.String())
+	}
+
+	endpointOK := false
+	r := newPeerResolver()
+	for _, endpoint := range opts.PeerEndpoints {
+		p := &peer{resolver: r, host: endpoint.host, port: endpoint.port}
+		name := fmt.Sprintf("endpoint %s", net.JoinHostPort(endpoint.host, fmt.Sprint(endpoint.port)))
+		ips, err := p.resolveHosts()
+		if c.report(name, err, fmt.Sprintf("%v", ips)) {
+			endpointOK = true
+		}
+	}
+	if c.failed || !endpointOK {
+		return errors.New("check failed")
+	}
+
+	dev, tnet, peer, err := setupNet()
+	if !c.report("device", err, "") {
+		return errors.New("check failed")
+	}
+	defer dev.Close()
+
+	// WireGuard only does handshake when there's something to send, a
+	// keepalive is enough.
+	keepalive := fmt.Sprintf("public_key=%s\nupdate_only=true\npersistent_keepalive_interval=%d\n", peer.pubKey, 25)
+	if err := dev.IpcSet(keepalive); err != nil {
+		logger.Errorf("Config device: %v", err)
+	}
+
+	var handshake time.Time
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s, err := deviceStats(dev, peer); err == nil && s.LastHandshakeTimestamp > 0 {
+			handshake = time.Unix(s.LastHandshakeTimestamp, 0)
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if handshake.IsZero() {
+		c.report("handshake", fmt.Errorf("no handshake in %s", timeout), "")
+		return errors.New("check failed")
+	}
+	c.report("handshake", nil, fmt.Sprintf("with %s", netip.AddrPortFrom(peer.ip, peer.port)))
+
+	dns := resolver.NewWithConfig(resolverConfig(opts.DNS), tnet.DialContext)
+	if opts.DNS == "" {
+		c.skip("dns", "--dns is not set")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ips, err := dns.LookupNetIP(ctx, "ip", c.Query)
+		cancel()
+		c.report("dns", err, fmt.Sprintf("%s is %v", c.Query, ips))
+	}
+
+	if c.Target == "" {
+		c.skip("dial", "--target is not set")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err := dialTarget(ctx, dns, tnet.DialContext, c.Target)
+		cancel()
+		detail := ""
+		if err == nil {
+			detail = fmt.Sprintf("connected to %s", conn.RemoteAddr())
+			conn.Close()
+		}
+		c.report("dial "+c.Target, err, detail)
+	}
+
+	if c.failed {
+		return errors.New("check failed")
+	}
+	return nil
+}
+
+func checkKey(key keyT) error {
+	if len(key) != 64 {
+		return fmt.Errorf("got %d bytes, want 32 bytes", len(key)/2)
+	}
+	return nil
+}
+
+func checkClientIPs() error {
+	if len(opts.ClientIPs) == 0 {
+		return errors.New("no client ip")
+	}
+	seen := map[ipT]bool{}
+	for _, ip := range opts.ClientIPs {
+		if !netip.Addr(ip).IsValid() {
+			return errors.New("invalid client ip")
+		}
+		if seen[ip] {
+			return fmt.Errorf("duplicated client ip %s", ip)
+		}
+		seen[ip] = true
+	}
+	return nil
+}
+
+func checkMTU(has6 bool) error {
+	if opts.MTU < 576 || opts.MTU > 65535 {
+		return fmt.Errorf("%d is out of range 576-65535", opts.MTU)
+	}
+	if has6 && opts.MTU < 1280 {
+		return fmt.Errorf("%d is less than 1280 required by IPv6", opts.MTU)
+	}
+	return nil
+}
+
+func checkFamily(ip netip.Addr, has4, has6 bool) error {
+	if ip.Is4() && !has4 {
+		return fmt.Errorf("%s is IPv4, but there's no IPv4 client ip", ip)
+	}
+	if ip.Is6() && !has6 {
+		return fmt.Errorf("%s is IPv6, but there's no IPv6 client ip", ip)
+	}
+	return nil
+}
+
+// dnsServerIP returns the server IP of a DNS option, if it's an IP.
+func dnsServerIP(dns string) (netip.Addr, bool) {
+	if i := strings.Index(dns, "://"); i >= 0 {
+		dns = dns[i+len("://"):]
+	}
+	if i := strings.Index(dns, "/"); i >= 0 {
+		dns = dns[:i]
+	}
+	if host, _, err := net.SplitHostPort(dns); err == nil {
+		dns = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(dns, "[]"))
+	return ip, err == nil
+}
+
+func dialTarget(ctx context.Context, r *resolver.Resolver, dial func(ctx context.Context, network, address string) (net.Conn, error), target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dial(ctx, "tcp", target)
+	}
+	ips, err := r.LookupNetIP(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dial(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
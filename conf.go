@@ -5,51 +5,110 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/zhsj/wghttp/internal/resolver"
 	"golang.zx2c4.com/wireguard/device"
 )
 
+// watchdogInterval is how often the watchdog checks the last handshake.
+const watchdogInterval = 5 * time.Second
+
+// minHandshakeTimeout is the smallest handshake timeout accepted. A healthy
+// tunnel only rekeys every device.RekeyAfterTime, so a shorter timeout would
+// recover it while nothing is wrong.
+const minHandshakeTimeout = 3 * time.Minute
+
+// failbackProbeTimeout is how long a handshake with the primary endpoint may
+// take after switching back, before returning to the backup endpoint.
+const failbackProbeTimeout = 3 * device.RekeyTimeout
+
 type peer struct {
 	resolver *resolver.Resolver
 
 	pubKey keyT
-	psk    keyT
+	psk    presharedKeyT
+
+	// endpoints are tried in order, the first one is the primary.
+	endpoints []hostPortT
+	current   int
+	switched  time.Time
+	// backup is the endpoint to return to if the primary one doesn't
+	// handshake after failback, or -1 if it's not probing.
+	backup int
 
 	host string
 	ip   netip.Addr
 	port uint16
+
+	// refresh asks the resolve loop to resolve the endpoint right now.
+	refresh chan struct{}
+
+	// lastHandshake is the last handshake seen by the watchdog, and
+	// stallTx is the sent bytes then, or at the last endpoint change.
+	// stallSince is when more bytes were first seen sent after that, or
+	// zero if none were.
+	lastHandshake time.Time
+	stallTx       int64
+	stallSince    time.Time
+	recoveries    int64
 }
 
 func newPeerEndpoint() (*peer, error) {
 	p := &peer{
-		pubKey: opts.PeerKey,
-		psk:    opts.PresharedKey,
-		host:   opts.PeerEndpoint.host,
-		port:   opts.PeerEndpoint.port,
+		pubKey:    opts.PeerKey,
+		psk:       opts.PresharedKey,
+		endpoints: opts.PeerEndpoints,
+		backup:    -1,
+
+		refresh: make(chan struct{}, 1),
 	}
+	for _, endpoint := range p.endpoints {
+		if _, err := netip.ParseAddr(endpoint.host); err != nil {
+			p.resolver = newPeerResolver()
+			break
+		}
+	}
+
+	if len(p.endpoints) > 1 && opts.HandshakeTimeout == 0 {
+		logger.Errorf("Peer endpoint failover needs --handshake-timeout")
+	}
+
 	var err error
-	p.ip, err = netip.ParseAddr(p.host)
-	if err == nil {
-		return p, nil
+	for i := range p.endpoints {
+		if err = p.use(i); err == nil {
+			return p, nil
+		}
+		logger.Errorf("Use peer endpoint: %v", err)
 	}
+	return nil, fmt.Errorf("resolve peer endpoint ip: %w", err)
+}
 
-	p.resolver = resolver.New(
-		opts.ResolveDNS,
+func newPeerResolver() *resolver.Resolver {
+	return resolver.NewWithConfig(
+		resolverConfig(opts.ResolveDNS),
 		func(ctx context.Context, network, address string) (net.Conn, error) {
 			netConn, err := (&net.Dialer{}).DialContext(ctx, network, address)
 			logger.Verbosef("Using %s to resolve peer endpoint: %v", opts.ResolveDNS, err)
 			return netConn, err
 		},
 	)
+}
 
-	p.ip, err = p.resolveHost()
+// use switches to the i-th endpoint, it doesn't update the device.
+func (p *peer) use(i int) error {
+	host, port := p.host, p.port
+	p.host, p.port = p.endpoints[i].host, p.endpoints[i].port
+	ip, err := p.resolveHost()
 	if err != nil {
-		return nil, fmt.Errorf("resolve peer endpoint ip: %w", err)
+		p.host, p.port = host, port
+		return err
 	}
-
-	return p, err
+	p.current, p.switched, p.ip = i, time.Now(), ip
+	return nil
 }
 
 func (p *peer) initConf() string {
@@ -62,7 +121,7 @@ func (p *peer) initConf() string {
 		conf += fmt.Sprintf("persistent_keepalive_interval=%d\n", opts.KeepaliveInterval)
 	}
 	if p.psk != "" {
-		conf += fmt.Sprintf("preshared_key=%s\n", p.psk)
+		conf += fmt.Sprintf("preshared_key=%s\n", string(p.psk))
 	}
 
 	return conf
@@ -80,63 +139,291 @@ func (p *peer) updateConf() (string, bool) {
 	p.ip = newIP
 	logger.Verbosef("PeerEndpoint is changed to: %s", p.ip)
 
+	return p.endpointConf(), true
+}
+
+func (p *peer) endpointConf() string {
 	conf := fmt.Sprintf("public_key=%s\n", p.pubKey)
 	conf += "update_only=true\n"
 	conf += fmt.Sprintf("endpoint=%s\n", netip.AddrPortFrom(p.ip, p.port))
-	return conf, true
+	return conf
+}
+
+// resolve triggers an immediate re-resolution of the peer endpoint. It
+// returns false if the endpoint is an IP address.
+func (p *peer) resolve() bool {
+	if p.resolver == nil {
+		return false
+	}
+	select {
+	case p.refresh <- struct{}{}:
+	default:
+	}
+	return true
 }
 
 func (p *peer) resolveHost() (netip.Addr, error) {
+	ips, err := p.resolveHosts()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ips[0], nil
+}
+
+// resolveHosts returns all reachable IPs of the peer endpoint.
+func (p *peer) resolveHosts() ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(p.host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
 	ips, err := p.resolver.LookupNetIP(context.Background(), "ip", p.host)
 	if err != nil {
-		return netip.Addr{}, fmt.Errorf("resolve ip for %s: %w", p.host, err)
+		return nil, fmt.Errorf("resolve ip for %s: %w", p.host, err)
 	}
+	available := []netip.Addr{}
 	for _, ip := range ips {
 		// netstack doesn't seem to understand IPv4-mapped IPv6 addresses.
 		ip = ip.Unmap()
 		conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, p.port)))
 		if err == nil {
 			conn.Close()
-			return ip, nil
+			available = append(available, ip)
 		} else {
 			logger.Verbosef("Dial %s: %s", ip, err)
 		}
 	}
-	return netip.Addr{}, fmt.Errorf("no available ip for %s", p.host)
+	if len(available) == 0 {
+		return nil, fmt.Errorf("no available ip for %s", p.host)
+	}
+	for _, ip := range available {
+		endpointHosts.Store(netip.AddrPortFrom(ip, p.port), p.host)
+	}
+	return available, nil
+}
+
+// watch checks whether the handshake is stalled, and recovers the tunnel if
+// it's stalled for longer than the handshake timeout.
+func (p *peer) watch(dev *device.Device) {
+	s, err := deviceStats(dev, p)
+	if err != nil {
+		return
+	}
+	stalled := p.stalled(s, time.Now())
+	if stalled < time.Duration(opts.HandshakeTimeout)*time.Second {
+		return
+	}
+	p.resetStall(s)
+	p.recover(dev, stalled)
 }
 
-func ipcSet(dev *device.Device) error {
-	conf := fmt.Sprintf("private_key=%s\n", opts.PrivateKey)
+// stalled returns how long the tunnel has been sending since the last
+// handshake, regardless of pauses in between. An idle tunnel isn't stalled,
+// and one sending again after being idle is only stalled from when it
+// started sending, as WireGuard starts a new handshake then.
+func (p *peer) stalled(s *statsT, now time.Time) time.Duration {
+	if handshake := time.Unix(s.LastHandshakeTimestamp, 0); !handshake.Equal(p.lastHandshake) {
+		p.lastHandshake = handshake
+		p.resetStall(s)
+	}
+	if s.SentBytes == p.stallTx {
+		return 0
+	}
+	if p.stallSince.IsZero() {
+		p.stallSince = now
+	}
+	return now.Sub(p.stallSince)
+}
+
+// resetStall restarts waiting for bytes sent after s.
+func (p *peer) resetStall(s *statsT) {
+	p.stallTx = s.SentBytes
+	p.stallSince = time.Time{}
+}
+
+// recover switches to the next endpoint, or the next IP of the endpoint if
+// there's only one, and rebinds the UDP socket to get a new NAT mapping.
+func (p *peer) recover(dev *device.Device, stalled time.Duration) {
+	atomic.AddInt64(&p.recoveries, 1)
+
+	if len(p.endpoints) > 1 {
+		for i := 1; i < len(p.endpoints); i++ {
+			next := (p.current + i) % len(p.endpoints)
+			if err := p.use(next); err != nil {
+				logger.Errorf("Use peer endpoint: %v", err)
+				continue
+			}
+			break
+		}
+	} else {
+		candidates, err := p.resolveHosts()
+		if err != nil {
+			logger.Errorf("Resolve peer endpoint: %v", err)
+			candidates = []netip.Addr{p.ip}
+		}
+		next := candidates[0]
+		for i, ip := range candidates {
+			if ip == p.ip {
+				next = candidates[(i+1)%len(candidates)]
+				break
+			}
+		}
+		p.ip = next
+	}
+	logger.Errorf("No handshake for %s, recovering with endpoint %s (%s) and a new socket",
+		stalled.Truncate(time.Second), net.JoinHostPort(p.host, strconv.Itoa(int(p.port))), p.ip)
+
+	conf := fmt.Sprintf("listen_port=%d\n", opts.ClientPort)
+	conf += p.endpointConf()
+	if err := dev.IpcSet(conf); err != nil {
+		logger.Errorf("Config device: %v", err)
+	}
+}
+
+// failback switches back to the primary endpoint after it has been on a
+// backup one for the failback interval. The primary one is probed with a
+// handshake, and if that doesn't succeed in time it returns to the backup.
+func (p *peer) failback(dev *device.Device) {
+	if p.backup >= 0 {
+		p.probe(dev)
+		return
+	}
+	if p.current == 0 || time.Since(p.switched) < time.Duration(opts.FailbackInterval)*time.Second {
+		return
+	}
+	s, err := deviceStats(dev, p)
+	if err != nil {
+		return
+	}
+	backup := p.current
+	if err := p.use(0); err != nil {
+		logger.Errorf("Use primary peer endpoint: %v", err)
+		p.switched = time.Now()
+		return
+	}
+	logger.Errorf("Switching back to primary endpoint %s (%s)",
+		net.JoinHostPort(p.host, strconv.Itoa(int(p.port))), p.ip)
+	p.resetStall(s)
+	if err := dev.IpcSet(p.endpointConf()); err != nil {
+		logger.Errorf("Config device: %v", err)
+		return
+	}
+	p.backup = backup
+	if err := p.handshake(dev); err != nil {
+		logger.Errorf("Send handshake to primary endpoint: %v", err)
+	}
+}
+
+// probe checks whether a handshake with the primary endpoint succeeded after
+// failback, and returns to the backup endpoint if it didn't in time.
+func (p *peer) probe(dev *device.Device) {
+	s, err := deviceStats(dev, p)
+	if err != nil {
+		return
+	}
+	if !time.Unix(s.LastHandshakeTimestamp, 0).Before(p.switched.Truncate(time.Second)) {
+		logger.Verbosef("Primary endpoint is back")
+		p.backup = -1
+		return
+	}
+	if time.Since(p.switched) < failbackProbeTimeout {
+		return
+	}
+	backup := p.backup
+	p.backup = -1
+	if err := p.use(backup); err != nil {
+		logger.Errorf("Use peer endpoint: %v", err)
+		return
+	}
+	logger.Errorf("No handshake with primary endpoint, returning to %s (%s)",
+		net.JoinHostPort(p.host, strconv.Itoa(int(p.port))), p.ip)
+	p.resetStall(s)
+	if err := dev.IpcSet(p.endpointConf()); err != nil {
+		logger.Errorf("Config device: %v", err)
+	}
+}
+
+// handshake starts a handshake with the peer right now, instead of waiting
+// for the current session to expire.
+func (p *peer) handshake(dev *device.Device) error {
+	var pk device.NoisePublicKey
+	if err := pk.FromHex(string(p.pubKey)); err != nil {
+		return err
+	}
+	wgPeer := dev.LookupPeer(pk)
+	if wgPeer == nil {
+		return fmt.Errorf("peer %s not found", p.pubKey)
+	}
+	return wgPeer.SendHandshakeInitiation(false)
+}
+
+func (p *peer) run(dev *device.Device) {
+	var resolveC, watchC, failbackC <-chan time.Time
+	if p.resolver != nil {
+		resolveC = time.Tick(time.Duration(opts.ResolveInterval) * time.Second)
+	}
+	if opts.HandshakeTimeout > 0 {
+		watchC = time.Tick(watchdogInterval)
+	}
+	if len(p.endpoints) > 1 && opts.FailbackInterval > 0 {
+		failbackC = time.Tick(watchdogInterval)
+	}
+
+	for {
+		select {
+		case <-resolveC:
+		case <-p.refresh:
+		case <-watchC:
+			p.watch(dev)
+			continue
+		case <-failbackC:
+			p.failback(dev)
+			continue
+		}
+		conf, needUpdate := p.updateConf()
+		if !needUpdate {
+			continue
+		}
+
+		if err := dev.IpcSet(conf); err != nil {
+			logger.Errorf("Config device: %v", err)
+		}
+	}
+}
+
+func ipcSet(dev *device.Device) (*peer, error) {
+	conf := fmt.Sprintf("private_key=%s\n", string(opts.PrivateKey))
 	if opts.ClientPort != 0 {
 		conf += fmt.Sprintf("listen_port=%d\n", opts.ClientPort)
 	}
 
 	peer, err := newPeerEndpoint()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	conf += peer.initConf()
-	logger.Verbosef("Device config:\n%s", conf)
+	logger.Verbosef("Device config:\n%s", redactConf(conf))
 
 	if err := dev.IpcSet(conf); err != nil {
-		return err
+		return nil, err
 	}
 
-	if peer.resolver != nil {
-		go func() {
-			c := time.Tick(time.Duration(opts.ResolveInterval) * time.Second)
-
-			for range c {
-				conf, needUpdate := peer.updateConf()
-				if !needUpdate {
-					continue
-				}
+	go peer.run(dev)
+	return peer, nil
+}
 
-				if err := dev.IpcSet(conf); err != nil {
-					logger.Errorf("Config device: %v", err)
-				}
-			}
-		}()
+// redactConf hides keys in a device config for logging.
+func redactConf(conf string) string {
+	lines := strings.SplitAfter(conf, "\n")
+	for i, line := range lines {
+		key, value, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "private_key":
+			lines[i] = key + "=" + privateKeyT(value).String() + "\n"
+		case "preshared_key":
+			lines[i] = key + "=" + presharedKeyT(value).String() + "\n"
+		}
 	}
-	return nil
+	return strings.Join(lines, "")
 }
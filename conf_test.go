@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactConf(t *testing.T) {
+	var private privateKeyT
+	if err := private.UnmarshalFlag("oK56DE9Ue9zK76rAc8pBl6opph+1v36lm7cXXsQKrQM="); err != nil {
+		t.Fatal(err)
+	}
+	var psk presharedKeyT
+	if err := psk.UnmarshalFlag("/UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak="); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := fmt.Sprintf("private_key=%s\npublic_key=abcd\npreshared_key=%s\n", string(private), string(psk))
+	got := redactConf(conf)
+	for _, secret := range []string{string(private), string(psk)} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redactConf() = %q, contains secret %s", got, secret)
+		}
+	}
+	if !strings.Contains(got, "public_key=abcd\n") {
+		t.Errorf("redactConf() = %q, want public key kept", got)
+	}
+	// cL9S5KV5wAy/AsKyYct3qz9BHxe5FYqxlb/eDthF/VY= is the public key.
+	if !strings.Contains(got, "private_key=(redacted, public key cL9S5KV5...)\n") {
+		t.Errorf("redactConf() = %q, want fingerprint of public key", got)
+	}
+
+	if s := fmt.Sprintf("%+v", struct{ Key presharedKeyT }{psk}); strings.Contains(s, string(psk)) {
+		t.Errorf("formatted %q contains secret", s)
+	}
+}
+
+func TestStalled(t *testing.T) {
+	const timeout = 3 * time.Minute
+	start := time.Unix(1700000000, 0)
+	p := &peer{}
+	s := &statsT{LastHandshakeTimestamp: start.Unix()}
+	// check advances the clock by a watchdog interval, sending n bytes
+	// before it.
+	now := start
+	check := func(n int64) time.Duration {
+		now = now.Add(watchdogInterval)
+		s.SentBytes += n
+		return p.stalled(s, now)
+	}
+
+	// An idle tunnel with a stale handshake isn't stalled.
+	for now.Sub(start) < 2*timeout {
+		if d := check(0); d != 0 {
+			t.Fatalf("idle tunnel stalled for %s", d)
+		}
+	}
+
+	// Sending only on some checks, the stall still grows from the first
+	// send, until it reaches the timeout.
+	first := now.Add(watchdogInterval)
+	for i := 0; ; i++ {
+		n := int64(0)
+		if i%3 == 0 {
+			n = 148
+		}
+		d := check(n)
+		if want := now.Sub(first); d != want {
+			t.Fatalf("stalled for %s after %s, want %s", d, now.Sub(start), want)
+		}
+		if d >= timeout {
+			break
+		}
+	}
+
+	// A new handshake ends the stall, and the next one starts from the
+	// next send.
+	s.LastHandshakeTimestamp = now.Unix()
+	for i, want := range []time.Duration{0, 0, watchdogInterval} {
+		if d := check(1000); d != want {
+			t.Errorf("stalled for %s at check %d after a handshake, want %s", d, i, want)
+		}
+	}
+
+	// So does resetting it after a recovery, until the next send.
+	p.resetStall(s)
+	if d := check(0); d != 0 {
+		t.Errorf("stalled for %s without sending after a reset", d)
+	}
+}
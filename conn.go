@@ -1,41 +1,230 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+
+	"github.com/zhsj/wghttp/internal/transport"
 )
 
+// endpointHosts maps resolved peer endpoints to their domains, which are
+// needed by WebSocket transports for Host header and TLS server name.
+var endpointHosts sync.Map
+
+func endpointHost(addr netip.AddrPort) string {
+	host, _ := endpointHosts.Load(addr)
+	s, _ := host.(string)
+	return s
+}
+
+func newTransportBind() conn.Bind {
+	switch opts.Transport {
+	case "tcp":
+		return &transport.Bind{Dial: transport.TCPDialer(), Logf: logger.Errorf}
+	case "ws", "wss":
+		header := http.Header{}
+		for _, h := range opts.TransportHeaders {
+			header.Add(h.name, h.value)
+		}
+		return &transport.Bind{
+			Dial: transport.WebSocketDialer(opts.Transport == "wss", opts.TransportPath, header, endpointHost),
+			Logf: logger.Errorf,
+		}
+	}
+	return conn.NewDefaultBind()
+}
+
+// WireGuard message types and sizes.
+const (
+	initiationType = 1
+	responseType   = 2
+	cookieType     = 3
+	transportType  = 4
+
+	initiationSize = 148
+	responseSize   = 92
+)
+
+// obfuscation hides WireGuard from DPI, compatible with AmneziaWG.
+type obfuscation struct {
+	// junkCount packets of junkMin to junkMax random bytes are sent
+	// before each handshake initiation.
+	junkCount, junkMin, junkMax int
+	// initPadding and responsePadding random bytes are prepended to
+	// handshake initiation and response.
+	initPadding, responsePadding int
+	// magic replaces the message type of initiation, response, cookie
+	// and transport messages.
+	magic [4]uint32
+}
+
+func (o *obfuscation) enabled() bool {
+	return o.junkCount > 0 || o.initPadding > 0 || o.responsePadding > 0 ||
+		o.magic != [4]uint32{initiationType, responseType, cookieType, transportType}
+}
+
 type connBind struct {
 	// magic 3 bytes in wireguard header reserved section.
 	clientID    []uint8
+	obfs        obfuscation
 	defaultBind conn.Bind
+
+	// sent counts bytes sent, and rotating makes the next Open pick a
+	// random port.
+	sent     uint64
+	rotating int32
+}
+
+func newConnBind(clientID string) (conn.Bind, error) {
+	var defaultBind conn.Bind
+	if opts.Sockets > 1 {
+		if opts.Transport != "udp" {
+			return nil, errors.New("multiple sockets only work with udp transport")
+		}
+		binds := make([]conn.Bind, 0, opts.Sockets)
+		for i := 0; i < opts.Sockets; i++ {
+			binds = append(binds, newTransportBind())
+		}
+		defaultBind = &multiBind{binds: binds}
+	} else {
+		defaultBind = newTransportBind()
+	}
+	c := &connBind{defaultBind: defaultBind}
+
+	c.obfs = obfuscation{
+		junkCount:       opts.JunkPacketCount,
+		junkMin:         opts.JunkPacketMinSize,
+		junkMax:         opts.JunkPacketMaxSize,
+		initPadding:     opts.InitPacketJunkSize,
+		responsePadding: opts.ResponsePacketJunkSize,
+		magic: [4]uint32{
+			opts.InitPacketMagicHeader, opts.ResponsePacketMagicHeader,
+			opts.UnderLoadPacketMagicHeader, opts.TransportPacketMagicHeader,
+		},
+	}
+	for i, m := range c.obfs.magic {
+		if m == 0 {
+			c.obfs.magic[i] = uint32(i + 1)
+		}
+	}
+	if err := c.obfs.validate(); err != nil {
+		return nil, err
+	}
+
+	if clientID != "" {
+		parsed, err := base64.StdEncoding.DecodeString(clientID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client id: %w", err)
+		}
+		if len(parsed) != 3 {
+			return nil, fmt.Errorf("invalid client id: got %d bytes, want 3 bytes", len(parsed))
+		}
+		// Obfuscated packets don't carry the reserved bytes.
+		if c.obfs.enabled() {
+			return nil, errors.New("client id can't be used with traffic obfuscation")
+		}
+		c.clientID = parsed
+	}
+
+	if c.clientID == nil && !c.obfs.enabled() && !rotatePort() {
+		return defaultBind, nil
+	}
+	return c, nil
+}
+
+func rotatePort() bool {
+	return opts.RotatePortInterval > 0 || opts.RotatePortBytes > 0
+}
+
+// rotate rebinds the device to a new random port periodically. Thanks to
+// roaming of WireGuard, the session keeps alive with the new port.
+func (c *connBind) rotate(dev *device.Device) {
+	if !rotatePort() {
+		return
+	}
+	if opts.ClientPort != 0 {
+		logger.Errorf("Port rotation doesn't work with --client-port")
+		return
+	}
+
+	var intervalC <-chan time.Time
+	if opts.RotatePortInterval > 0 {
+		intervalC = time.Tick(time.Duration(opts.RotatePortInterval) * time.Second)
+	}
+	var bytesC <-chan time.Time
+	if opts.RotatePortBytes > 0 {
+		bytesC = time.Tick(watchdogInterval)
+	}
+	var lastSent uint64
+	for {
+		select {
+		case <-intervalC:
+		case <-bytesC:
+			if atomic.LoadUint64(&c.sent)-lastSent < uint64(opts.RotatePortBytes) {
+				continue
+			}
+		}
+		lastSent = atomic.LoadUint64(&c.sent)
+		atomic.StoreInt32(&c.rotating, 1)
+		if err := dev.BindUpdate(); err != nil {
+			logger.Errorf("Rotate port: %v", err)
+			continue
+		}
+		logger.Verbosef("Rotated to a new port")
+	}
 }
 
-func newConnBind(clientID string) conn.Bind {
-	defaultBind := conn.NewDefaultBind()
-	if clientID == "" {
-		return defaultBind
+func (o *obfuscation) validate() error {
+	if o.junkCount < 0 || o.junkMin < 0 || o.junkMax < o.junkMin || o.junkMax > maxJunkSize {
+		return fmt.Errorf("invalid junk packet size: %d-%d", o.junkMin, o.junkMax)
+	}
+	if o.junkCount > 0 && o.junkMax == 0 {
+		return errors.New("junk packet max size is required for junk packets")
+	}
+	if o.initPadding < 0 || o.responsePadding < 0 || o.initPadding > maxJunkSize || o.responsePadding > maxJunkSize {
+		return fmt.Errorf("invalid packet junk size: %d, %d", o.initPadding, o.responsePadding)
 	}
-	parsed, err := base64.StdEncoding.DecodeString(clientID)
-	if err != nil {
-		logger.Errorf("Invalid client id: %v, fallback to default", err)
-		return defaultBind
+	// Padded initiation and response are told apart by size.
+	if o.initPadding > 0 && o.initPadding+initiationSize == o.responsePadding+responseSize {
+		return errors.New("init and response packet have the same size after padding")
 	}
-	return &connBind{clientID: parsed, defaultBind: defaultBind}
+	seen := map[uint32]bool{}
+	for _, m := range o.magic {
+		if seen[m] {
+			return fmt.Errorf("duplicated magic header: %d", m)
+		}
+		seen[m] = true
+	}
+	return nil
 }
 
+// maxJunkSize keeps junk and padded packets within a common MTU.
+const maxJunkSize = 1280
+
 func (c *connBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	if atomic.CompareAndSwapInt32(&c.rotating, 1, 0) {
+		port = 0
+	}
 	fns, actualPort, err := c.defaultBind.Open(port)
 	newFNs := make([]conn.ReceiveFunc, 0, len(fns))
 	for i := range fns {
 		f := fns[i]
 		newFNs = append(newFNs, func(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
 			n, err = f(packets, sizes, eps)
-			for i := range packets {
-				if len(packets[i]) > 4 {
-					copy(packets[i][1:4], []byte{0, 0, 0})
-				}
+			for i := 0; i < n; i++ {
+				sizes[i] = c.decode(packets[i][:sizes[i]])
 			}
 			return
 		})
@@ -43,6 +232,53 @@ func (c *connBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
 	return newFNs, actualPort, err
 }
 
+// decode restores a received packet in place and returns its new size, or
+// 0 if it should be ignored.
+func (c *connBind) decode(p []byte) int {
+	if !c.obfs.enabled() {
+		if c.clientID != nil && len(p) > 4 {
+			copy(p[1:4], []byte{0, 0, 0})
+		}
+		return len(p)
+	}
+
+	for _, padded := range []struct {
+		padding, size int
+		typ           uint32
+	}{
+		{c.obfs.initPadding, initiationSize, initiationType},
+		{c.obfs.responsePadding, responseSize, responseType},
+	} {
+		if padded.padding == 0 || len(p) != padded.padding+padded.size {
+			continue
+		}
+		if binary.LittleEndian.Uint32(p[padded.padding:]) != c.obfs.magic[padded.typ-1] {
+			continue
+		}
+		copy(p, p[padded.padding:])
+		binary.LittleEndian.PutUint32(p, padded.typ)
+		return padded.size
+	}
+
+	if len(p) < 4 {
+		return 0
+	}
+	header := binary.LittleEndian.Uint32(p)
+	for i, m := range c.obfs.magic {
+		typ := uint32(i + 1)
+		if header != m {
+			continue
+		}
+		if (typ == initiationType && c.obfs.initPadding > 0) || (typ == responseType && c.obfs.responsePadding > 0) {
+			break
+		}
+		binary.LittleEndian.PutUint32(p, typ)
+		return len(p)
+	}
+	// Junk packets, or packets from peers without obfuscation.
+	return 0
+}
+
 func (c *connBind) BatchSize() int {
 	return c.defaultBind.BatchSize()
 }
@@ -52,14 +288,132 @@ func (c *connBind) Close() error { return c.defaultBind.Close() }
 func (c *connBind) SetMark(mark uint32) error { return c.defaultBind.SetMark(mark) }
 
 func (c *connBind) Send(bufs [][]byte, ep conn.Endpoint) error {
-	for i := range bufs {
-		if len(bufs[i]) > 4 {
-			copy(bufs[i][1:4], c.clientID)
+	for _, buf := range bufs {
+		atomic.AddUint64(&c.sent, uint64(len(buf)))
+	}
+	if !c.obfs.enabled() {
+		for i := range bufs {
+			if len(bufs[i]) > 4 {
+				copy(bufs[i][1:4], c.clientID)
+			}
 		}
+		return c.defaultBind.Send(bufs, ep)
 	}
-	return c.defaultBind.Send(bufs, ep)
+
+	encoded := make([][]byte, 0, len(bufs))
+	for _, buf := range bufs {
+		if len(buf) < 4 {
+			encoded = append(encoded, buf)
+			continue
+		}
+		typ := binary.LittleEndian.Uint32(buf)
+		if typ < initiationType || typ > transportType {
+			encoded = append(encoded, buf)
+			continue
+		}
+		padding := 0
+		switch {
+		case typ == initiationType && len(buf) == initiationSize:
+			if err := c.sendJunk(ep); err != nil {
+				return err
+			}
+			padding = c.obfs.initPadding
+		case typ == responseType && len(buf) == responseSize:
+			padding = c.obfs.responsePadding
+		}
+		if padding > 0 {
+			padded := make([]byte, padding+len(buf))
+			_, _ = rand.Read(padded[:padding])
+			copy(padded[padding:], buf)
+			buf = padded
+		}
+		binary.LittleEndian.PutUint32(buf[padding:], c.obfs.magic[typ-1])
+		encoded = append(encoded, buf)
+	}
+	return c.defaultBind.Send(encoded, ep)
+}
+
+func (c *connBind) sendJunk(ep conn.Endpoint) error {
+	if c.obfs.junkCount == 0 {
+		return nil
+	}
+	junk := make([][]byte, 0, c.obfs.junkCount)
+	for i := 0; i < c.obfs.junkCount; i++ {
+		size := c.obfs.junkMin
+		if c.obfs.junkMax > c.obfs.junkMin {
+			n, _ := rand.Int(rand.Reader, big.NewInt(int64(c.obfs.junkMax-c.obfs.junkMin+1)))
+			size += int(n.Int64())
+		}
+		b := make([]byte, size)
+		_, _ = rand.Read(b)
+		junk = append(junk, b)
+	}
+	// Junk packets are sent one by one, as a batch might be coalesced.
+	for _, b := range junk {
+		if err := c.defaultBind.Send([][]byte{b}, ep); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *connBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 	return c.defaultBind.ParseEndpoint(s)
 }
+
+// multiBind spreads sends across several sockets, and receives from all of
+// them.
+type multiBind struct {
+	binds []conn.Bind
+	next  uint32
+}
+
+func (m *multiBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	var fns []conn.ReceiveFunc
+	var actualPort uint16
+	for i, b := range m.binds {
+		bindFNs, bindPort, err := b.Open(port)
+		if err != nil {
+			for _, opened := range m.binds[:i] {
+				opened.Close()
+			}
+			return nil, 0, err
+		}
+		if i == 0 {
+			// Only the first socket uses the configured port.
+			actualPort, port = bindPort, 0
+		}
+		fns = append(fns, bindFNs...)
+	}
+	return fns, actualPort, nil
+}
+
+func (m *multiBind) Close() error {
+	var err error
+	for _, b := range m.binds {
+		if closeErr := b.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (m *multiBind) SetMark(mark uint32) error {
+	for _, b := range m.binds {
+		if err := b.SetMark(mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multiBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	i := atomic.AddUint32(&m.next, 1) % uint32(len(m.binds))
+	return m.binds[i].Send(bufs, ep)
+}
+
+func (m *multiBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return m.binds[0].ParseEndpoint(s)
+}
+
+func (m *multiBind) BatchSize() int { return m.binds[0].BatchSize() }
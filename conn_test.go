@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// loopBind receives what it sends.
+type loopBind struct {
+	conn.Bind
+	sent [][]byte
+}
+
+func (b *loopBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fn := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n := 0
+		for ; n < len(b.sent) && n < len(packets); n++ {
+			sizes[n] = copy(packets[n], b.sent[n])
+		}
+		b.sent = b.sent[n:]
+		return n, nil
+	}
+	return []conn.ReceiveFunc{fn}, port, nil
+}
+
+func (b *loopBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	for _, buf := range bufs {
+		b.sent = append(b.sent, append([]byte(nil), buf...))
+	}
+	return nil
+}
+
+func TestObfuscation(t *testing.T) {
+	message := func(typ uint32, size int) []byte {
+		b := bytes.Repeat([]byte{0xff}, size)
+		binary.LittleEndian.PutUint32(b, typ)
+		return b
+	}
+	initiation := message(initiationType, initiationSize)
+	response := message(responseType, responseSize)
+	cookie := message(cookieType, 64)
+	transport := message(transportType, 100)
+
+	lb := &loopBind{}
+	c := &connBind{defaultBind: lb, obfs: obfuscation{
+		junkCount: 3, junkMin: 10, junkMax: 50,
+		initPadding: 20, responsePadding: 30,
+		magic: [4]uint32{1234, 5678, 9012, 3456},
+	}}
+	if err := c.obfs.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range [][]byte{initiation, response, cookie, transport} {
+		if err := c.Send([][]byte{append([]byte(nil), m...)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(lb.sent) != 3+4 {
+		t.Fatalf("got %d packets sent, want 7", len(lb.sent))
+	}
+	for i, p := range lb.sent[:3] {
+		if len(p) < 10 || len(p) > 50 {
+			t.Errorf("junk packet %d has %d bytes", i, len(p))
+		}
+	}
+	if got := len(lb.sent[3]); got != 20+initiationSize {
+		t.Errorf("got initiation of %d bytes, want %d bytes", got, 20+initiationSize)
+	}
+	if got := binary.LittleEndian.Uint32(lb.sent[6]); got != 3456 {
+		t.Errorf("got transport header %d, want 3456", got)
+	}
+
+	fns, _, _ := c.Open(0)
+	packets := make([][]byte, 8)
+	for i := range packets {
+		packets[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, len(packets))
+	n, err := fns[0](packets, sizes, make([]conn.Endpoint, len(packets)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := [][]byte{}
+	for i := 0; i < n; i++ {
+		if sizes[i] > 0 {
+			got = append(got, packets[i][:sizes[i]])
+		}
+	}
+	want := [][]byte{initiation, response, cookie, transport}
+	if len(got) != len(want) {
+		t.Fatalf("got %d packets, want %d packets", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("packet %d: got %x, want %x", i, got[i][:4], want[i][:4])
+		}
+	}
+}
+
+func TestClientIDWithObfuscation(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+
+	opts.JunkPacketCount, opts.JunkPacketMaxSize = 3, 50
+	if _, err := newConnBind("AQID"); err == nil {
+		t.Error("newConnBind() with junk packets: got nil error")
+	}
+
+	opts.JunkPacketCount, opts.JunkPacketMaxSize = 0, 0
+	opts.InitPacketJunkSize = 20
+	if _, err := newConnBind("AQID"); err == nil {
+		t.Error("newConnBind() with padding: got nil error")
+	}
+
+	opts.InitPacketJunkSize = 0
+	b, err := newConnBind("AQID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := b.(*connBind)
+	lb := &loopBind{}
+	c.defaultBind = lb
+	transport := make([]byte, 100)
+	binary.LittleEndian.PutUint32(transport, transportType)
+	if err := c.Send([][]byte{transport}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := lb.sent[0][1:4]; !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("got reserved bytes %x, want 010203", got)
+	}
+}
+
+func TestTransportHeader(t *testing.T) {
+	var h headerT
+	if err := h.UnmarshalFlag("Authorization: Bearer secret"); err != nil {
+		t.Fatal(err)
+	}
+	if h.name != "Authorization" || h.value != "Bearer secret" {
+		t.Errorf("UnmarshalFlag() = %q, %q", h.name, h.value)
+	}
+	if s := fmt.Sprintf("%+v", struct{ Headers []headerT }{[]headerT{h}}); strings.Contains(s, "secret") {
+		t.Errorf("formatted %q contains header value", s)
+	}
+
+	for _, invalid := range []string{"Authorization", ": value"} {
+		if err := h.UnmarshalFlag(invalid); err == nil {
+			t.Errorf("UnmarshalFlag(%q): got nil error", invalid)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/zhsj/wghttp/internal/resolver"
+)
+
+// staticHosts are from --hosts-file and --host, loaded by loadHosts.
+var staticHosts map[string][]netip.Addr
+
+func loadHosts() error {
+	staticHosts = map[string][]netip.Addr{}
+	if opts.HostsFile != "" {
+		f, err := os.Open(opts.HostsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hosts, err := resolver.ParseHosts(f)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", opts.HostsFile, err)
+		}
+		staticHosts = hosts
+	}
+	for _, h := range opts.Hosts {
+		staticHosts[h.name] = append(staticHosts[h.name], h.ip)
+	}
+	return nil
+}
+
+// resolverConfig returns the config of resolving with dns, along with
+// static hosts and --dns-route.
+func resolverConfig(dns string) resolver.Config {
+	cfg := resolver.Config{DNS: dns, Hosts: staticHosts}
+	for _, r := range opts.DNSRoutes {
+		cfg.Routes = append(cfg.Routes, resolver.Route{Suffix: r.suffix, DNS: r.dns})
+	}
+	return cfg
+}
@@ -0,0 +1,197 @@
+package limit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when a client has used up its quota.
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+	// retention is how long daily records are kept.
+	retention = 400 * 24 * time.Hour
+	// accountBatch is how many bytes a session counts before adding them
+	// to Accounting, which is also done when it ends.
+	accountBatch = 1 << 20
+)
+
+// Usage is traffic in bytes. Upload is from clients to servers, and
+// download is from servers to clients.
+type Usage struct {
+	Upload   int64
+	Download int64
+}
+
+func (u Usage) total() int64 { return u.Upload + u.Download }
+
+// Accounting records traffic of sessions per client and day, and refuses
+// sessions of clients which used up their monthly quota.
+type Accounting struct {
+	// Path is the JSON file to keep records across restarts, records are
+	// only in memory if it's empty.
+	Path string
+	// Quota is the bytes a client can use in a month, zero means no quota.
+	Quota int64
+
+	mu sync.Mutex
+	// days maps a day to usage of clients on that day.
+	days map[string]map[string]*Usage
+	// monthly is the total traffic of clients in month, which is checked
+	// against Quota.
+	month   string
+	monthly map[string]int64
+	// changes counts changes of days, and saved is its value when they
+	// were written to Path.
+	changes, saved int64
+}
+
+// Load reads records from Path, it's fine if the file doesn't exist.
+func (a *Accounting) Load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.days = map[string]map[string]*Usage{}
+	a.month, a.monthly = "", nil
+	if a.Path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(a.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, &a.days); err != nil {
+		return fmt.Errorf("decode %s: %w", a.Path, err)
+	}
+	a.rollMonth(time.Now())
+	for day, clients := range a.days {
+		if strings.HasPrefix(day, a.month) {
+			for client, u := range clients {
+				a.monthly[client] += u.total()
+			}
+		}
+	}
+	return nil
+}
+
+// Save writes records to Path if they're changed.
+func (a *Accounting) Save() error {
+	a.mu.Lock()
+	if a.Path == "" || a.changes == a.saved {
+		a.mu.Unlock()
+		return nil
+	}
+	expired := time.Now().Add(-retention).Format(dayLayout)
+	for day := range a.days {
+		if day < expired {
+			delete(a.days, day)
+		}
+	}
+	content, err := json.MarshalIndent(a.days, "", "  ")
+	changes := a.changes
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := a.write(content); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.saved = changes
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *Accounting) write(content []byte) error {
+	// Write to a temporary file then rename, so the file is never half
+	// written.
+	f, err := os.CreateTemp(filepath.Dir(a.Path), filepath.Base(a.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), a.Path)
+}
+
+// rollMonth starts counting monthly traffic anew if now is in another month.
+func (a *Accounting) rollMonth(now time.Time) {
+	if month := now.Format(monthLayout); month != a.month || a.monthly == nil {
+		a.month, a.monthly = month, map[string]int64{}
+	}
+}
+
+// check returns ErrQuotaExceeded if client has used up its quota.
+func (a *Accounting) check(client string) error {
+	if a.Quota <= 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollMonth(time.Now())
+	if a.monthly[client] >= a.Quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (a *Accounting) add(client string, u Usage) {
+	now := time.Now()
+	day := now.Format(dayLayout)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.days == nil {
+		a.days = map[string]map[string]*Usage{}
+	}
+	clients := a.days[day]
+	if clients == nil {
+		clients = map[string]*Usage{}
+		a.days[day] = clients
+	}
+	usage := clients[client]
+	if usage == nil {
+		usage = &Usage{}
+		clients[client] = usage
+	}
+	usage.Upload += u.Upload
+	usage.Download += u.Download
+	a.rollMonth(now)
+	a.monthly[client] += u.total()
+	a.changes++
+}
+
+// Report returns usage of clients in days starting with prefix, e.g.
+// "2006-01" for a month or "2006-01-02" for a day.
+func (a *Accounting) Report(prefix string) map[string]Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := map[string]Usage{}
+	for day, clients := range a.days {
+		if !strings.HasPrefix(day, prefix) {
+			continue
+		}
+		for client, u := range clients {
+			sum := report[client]
+			sum.Upload += u.Upload
+			sum.Download += u.Download
+			report[client] = sum
+		}
+	}
+	return report
+}
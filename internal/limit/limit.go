@@ -0,0 +1,110 @@
+// Package limit limits concurrent proxied sessions, globally and per
+// client.
+package limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrLimited is wrapped by all errors of reaching a limit.
+	ErrLimited = errors.New("too many connections")
+	// ErrGlobalLimit is returned when the global limit is reached.
+	ErrGlobalLimit = fmt.Errorf("%w in total", ErrLimited)
+	// ErrClientLimit is returned when the limit of a client is reached.
+	ErrClientLimit = fmt.Errorf("%w from the client", ErrLimited)
+)
+
+type (
+	clientKey struct{}
+	userKey   struct{}
+)
+
+// WithClient returns a context carrying the client of conn, which is the IP
+// of its remote address.
+func WithClient(ctx context.Context, conn net.Conn) context.Context {
+	client := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// WithUser returns a context carrying the authenticated user, which is the
+// client instead of the IP.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// Client returns the user carried by ctx, or the client IP if there's no
+// user, or "" if there's neither.
+func Client(ctx context.Context) string {
+	if user, ok := ctx.Value(userKey{}).(string); ok {
+		return user
+	}
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// Limiter limits concurrent sessions started with it, zero means no limit.
+type Limiter struct {
+	Max          int
+	MaxPerClient int
+
+	mu      sync.Mutex
+	active  int
+	clients map[string]int
+
+	rejectedGlobal, rejectedClient int64
+}
+
+// Stats are counters of a Limiter.
+type Stats struct {
+	Active         int
+	RejectedGlobal int64
+	RejectedClient int64
+}
+
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	return Stats{
+		Active:         active,
+		RejectedGlobal: atomic.LoadInt64(&l.rejectedGlobal),
+		RejectedClient: atomic.LoadInt64(&l.rejectedClient),
+	}
+}
+
+func (l *Limiter) acquire(client string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Max > 0 && l.active >= l.Max {
+		atomic.AddInt64(&l.rejectedGlobal, 1)
+		return ErrGlobalLimit
+	}
+	if l.MaxPerClient > 0 && client != "" && l.clients[client] >= l.MaxPerClient {
+		atomic.AddInt64(&l.rejectedClient, 1)
+		return ErrClientLimit
+	}
+	if l.clients == nil {
+		l.clients = map[string]int{}
+	}
+	l.active++
+	l.clients[client]++
+	return nil
+}
+
+func (l *Limiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
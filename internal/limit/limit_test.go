@@ -0,0 +1,206 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type addrConn struct {
+	net.Conn
+	addr string
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func TestLimiter(t *testing.T) {
+	l := &Limiter{Max: 5, MaxPerClient: 2}
+	p := &Policy{Limiter: l}
+	client := func(addr string) context.Context {
+		return WithClient(context.Background(), addrConn{addr: addr})
+	}
+	user := func(addr, name string) context.Context {
+		return WithUser(client(addr), name)
+	}
+
+	var sessions []*Session
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"first of IP", client("192.0.2.1:1000"), nil},
+		{"second of IP", client("192.0.2.1:1001"), nil},
+		{"third of IP", client("192.0.2.1:1002"), ErrClientLimit},
+		// Users are told apart from their IPs.
+		{"first of user", user("192.0.2.1:1003", "alice"), nil},
+		{"second of user", user("192.0.2.2:1000", "alice"), nil},
+		{"third of user", user("192.0.2.3:1000", "alice"), ErrClientLimit},
+		{"another IP", client("192.0.2.2:1000"), nil},
+		{"over total", client("192.0.2.4:1000"), ErrGlobalLimit},
+	} {
+		s, err := p.Start(tc.ctx)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if err == nil {
+			sessions = append(sessions, s)
+		}
+	}
+
+	// Ending releases the slot, and ending again doesn't.
+	sessions[0].End()
+	sessions[0].End()
+	if _, err := p.Start(client("192.0.2.1:1003")); err != nil {
+		t.Errorf("start after end: %v", err)
+	}
+	if _, err := p.Start(client("192.0.2.4:1000")); !errors.Is(err, ErrGlobalLimit) {
+		t.Errorf("start after double end: got %v, want %v", err, ErrGlobalLimit)
+	}
+
+	if s := l.Stats(); s.Active != 5 || s.RejectedGlobal != 2 || s.RejectedClient != 2 {
+		t.Errorf("Stats() = %+v", s)
+	}
+
+	// A nil Policy starts nil sessions, which can be ended.
+	var none *Policy
+	s, err := none.Start(client("192.0.2.1:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.End()
+}
+
+// zeroConn reads and writes endlessly.
+type zeroConn struct{ net.Conn }
+
+func (zeroConn) Read(p []byte) (int, error)  { return len(p), nil }
+func (zeroConn) Write(p []byte) (int, error) { return len(p), nil }
+func (zeroConn) Close() error                { return nil }
+
+// fakeClock only moves forward when it's waited on.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.t = c.t.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func TestShaper(t *testing.T) {
+	s := NewShaper(ShaperConfig{
+		Download:     Bandwidth{Rate: 200 << 10, Burst: 20 << 10},
+		ClientUpload: Bandwidth{Rate: 100 << 10, Burst: 10 << 10},
+	})
+	clock := &fakeClock{t: time.Now()}
+	s.now, s.after = clock.now, clock.after
+	p := &Policy{Shaper: s}
+	sess, err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.End()
+	download, upload := sess.Download(zeroConn{}), sess.Upload(zeroConn{})
+
+	// measure reads for 10 seconds of the clock. As the clock only moves
+	// by waits, the bytes read are those added to the bucket at the rate,
+	// and at most a burst which was already in it.
+	measure := func(name string, r io.Reader, b Bandwidth) {
+		t.Helper()
+		start, total := clock.t, 0.0
+		buf := make([]byte, 64<<10)
+		// Without waits, stop reading once it's clearly too much.
+		tooMuch := float64(b.Rate)*10 + float64(b.Burst) + float64(len(buf))
+		for clock.t.Sub(start) < 10*time.Second && total <= tooMuch {
+			n, err := r.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += float64(n)
+		}
+		added := float64(b.Rate) * clock.t.Sub(start).Seconds()
+		// Allow a byte of rounding in durations.
+		if total < added-1 || total > added+float64(b.Burst)+1 {
+			t.Errorf("%s: read %.0f bytes, want %.0f plus at most a burst of %d", name, total, added, b.Burst)
+		}
+	}
+
+	measure("download", download, Bandwidth{Rate: 200 << 10, Burst: 20 << 10})
+	measure("upload", upload, Bandwidth{Rate: 100 << 10, Burst: 10 << 10})
+
+	s.SetConfig(ShaperConfig{Download: Bandwidth{Rate: 400 << 10}})
+	measure("download after change", download, Bandwidth{Rate: 400 << 10, Burst: 400 << 10})
+
+	if st := s.Stats(); st.Waits == 0 || st.Waiting != 0 {
+		t.Errorf("Stats() = %+v", st)
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting.json")
+	a := &Accounting{Path: path, Quota: 100}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	p := &Policy{Accounting: a}
+	ctx := WithClient(context.Background(), addrConn{addr: "192.0.2.1:1000"})
+
+	sess, err := p.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = sess.Upload(zeroConn{}).Read(make([]byte, 40))
+	_, _ = sess.Download(zeroConn{}).Read(make([]byte, 60))
+	if got := a.Report("")["192.0.2.1"]; got != (Usage{}) {
+		t.Errorf("Report() before the session ends = %+v", got)
+	}
+	sess.End()
+	if _, err := p.Start(ctx); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("session over quota: got %v, want %v", err, ErrQuotaExceeded)
+	}
+	other := WithClient(context.Background(), addrConn{addr: "192.0.2.2:1000"})
+	sess, err = p.Start(other)
+	if err != nil {
+		t.Fatalf("session of another client: %v", err)
+	}
+	// Long sessions are counted before they end.
+	_, _ = sess.Download(zeroConn{}).Read(make([]byte, accountBatch))
+	if got, want := a.Report("")["192.0.2.2"], (Usage{Download: accountBatch}); got != want {
+		t.Errorf("Report() of a long session = %+v, want %+v", got, want)
+	}
+	sess.End()
+
+	// Records failed to save are saved next time.
+	a.Path = filepath.Join(path, "missing", "accounting.json")
+	if err := a.Save(); err == nil {
+		t.Fatal("Save() to a missing directory succeeded")
+	}
+	a.Path = path
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	b := &Accounting{Path: path, Quota: 100}
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{Upload: 40, Download: 60}
+	if got := b.Report(time.Now().Format("2006-01"))["192.0.2.1"]; got != want {
+		t.Errorf("Report() after reload = %+v, want %+v", got, want)
+	}
+	if got := b.Report("1999")["192.0.2.1"]; got != (Usage{}) {
+		t.Errorf("Report() of another period = %+v", got)
+	}
+	if _, err := (&Policy{Accounting: b}).Start(ctx); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("session over quota after reload: got %v, want %v", err, ErrQuotaExceeded)
+	}
+}
@@ -0,0 +1,172 @@
+package limit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// Policy applies limits to proxied sessions of clients, nil fields are not
+// applied.
+type Policy struct {
+	Limiter    *Limiter
+	Shaper     *Shaper
+	Accounting *Accounting
+}
+
+// Session is a proxied session of a client, e.g. a SOCKS5 connection, a
+// CONNECT tunnel or a plain HTTP request. Methods of a nil Session do
+// nothing.
+type Session struct {
+	policy *Policy
+	client string
+	once   sync.Once
+
+	// upload and download are the buckets of Shaper, and ctx is done when
+	// the session ends, which stops waiting for them.
+	upload, download []*rate.Limiter
+	ctx              context.Context
+	cancel           context.CancelFunc
+
+	// uploaded and downloaded are bytes not added to Accounting yet.
+	uploaded, downloaded int64
+}
+
+// Start starts a session of the client carried by ctx, or returns an error
+// if the client can't start one now. A nil Policy starts nil sessions.
+func (p *Policy) Start(ctx context.Context) (*Session, error) {
+	if p == nil {
+		return nil, nil
+	}
+	client := Client(ctx)
+	if p.Accounting != nil {
+		if err := p.Accounting.check(client); err != nil {
+			return nil, err
+		}
+	}
+	if p.Limiter != nil {
+		if err := p.Limiter.acquire(client); err != nil {
+			return nil, err
+		}
+	}
+	s := &Session{policy: p, client: client}
+	if p.Shaper != nil {
+		buckets := p.Shaper.acquire(client)
+		s.upload = []*rate.Limiter{p.Shaper.upload, buckets.upload}
+		s.download = []*rate.Limiter{p.Shaper.download, buckets.download}
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s, nil
+}
+
+// Upload returns a reader of r, which is read from the client.
+func (s *Session) Upload(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return s.reader(r, s.upload, &s.uploaded)
+}
+
+// Download returns a reader of r, which is read from the server.
+func (s *Session) Download(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return s.reader(r, s.download, &s.downloaded)
+}
+
+func (s *Session) reader(r io.Reader, limiters []*rate.Limiter, count *int64) io.Reader {
+	if limiters == nil && s.policy.Accounting == nil {
+		return r
+	}
+	sr := &sessionReader{r: r, session: s, limiters: limiters, count: count}
+	if _, ok := r.(io.WriterTo); ok {
+		return sessionWriterTo{sr}
+	}
+	return sr
+}
+
+// account adds what's counted to Accounting.
+func (s *Session) account() {
+	u := Usage{
+		Upload:   atomic.SwapInt64(&s.uploaded, 0),
+		Download: atomic.SwapInt64(&s.downloaded, 0),
+	}
+	if u.total() > 0 {
+		s.policy.Accounting.add(s.client, u)
+	}
+}
+
+// sessionReader waits for bandwidth after reading, and counts bytes read,
+// which are added to Accounting in batches.
+type sessionReader struct {
+	r        io.Reader
+	session  *Session
+	limiters []*rate.Limiter
+	count    *int64
+}
+
+func (r *sessionReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if terr := r.take(n); terr != nil {
+		return n, terr
+	}
+	return n, err
+}
+
+// sessionWriterTo is a sessionReader of an io.WriterTo, whose WriteTo is
+// kept, e.g. to copy whole datagrams.
+type sessionWriterTo struct {
+	*sessionReader
+}
+
+func (r sessionWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return r.r.(io.WriterTo).WriteTo(writerFunc(func(p []byte) (int, error) {
+		if err := r.take(len(p)); err != nil {
+			return 0, err
+		}
+		return w.Write(p)
+	}))
+}
+
+func (r *sessionReader) take(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	s := r.session
+	if r.limiters != nil {
+		if err := s.policy.Shaper.take(s.ctx, r.limiters, n); err != nil {
+			return err
+		}
+	}
+	if s.policy.Accounting != nil && atomic.AddInt64(r.count, int64(n)) >= accountBatch {
+		s.account()
+	}
+	return nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// End ends the session, only the first call does.
+func (s *Session) End() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		if s.policy.Limiter != nil {
+			s.policy.Limiter.release(s.client)
+		}
+		if s.policy.Shaper != nil {
+			s.cancel()
+			s.policy.Shaper.release(s.client)
+		}
+		if s.policy.Accounting != nil {
+			s.account()
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth is a token bucket of bytes, zero Rate means no limit.
+type Bandwidth struct {
+	// Rate is in bytes per second.
+	Rate int64
+	// Burst is in bytes, default to Rate.
+	Burst int64
+}
+
+func (b Bandwidth) set(l *rate.Limiter, now time.Time) {
+	if b.Rate <= 0 {
+		l.SetLimitAt(now, rate.Inf)
+		return
+	}
+	burst := b.Burst
+	if burst <= 0 {
+		burst = b.Rate
+	}
+	l.SetLimitAt(now, rate.Limit(b.Rate))
+	l.SetBurstAt(now, int(burst))
+}
+
+func (b Bandwidth) limiter(now time.Time) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	b.set(l, now)
+	return l
+}
+
+// ShaperConfig is the bandwidth of a Shaper. Upload is from clients to
+// servers, and download is from servers to clients.
+type ShaperConfig struct {
+	Upload         Bandwidth
+	Download       Bandwidth
+	ClientUpload   Bandwidth
+	ClientDownload Bandwidth
+}
+
+// Shaper limits bandwidth of sessions, globally and per client.
+type Shaper struct {
+	mu       sync.Mutex
+	cfg      ShaperConfig
+	upload   *rate.Limiter
+	download *rate.Limiter
+	clients  map[string]*clientBuckets
+
+	// now and after are time.Now and time.After, except in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	waiting, waits int64
+}
+
+type clientBuckets struct {
+	upload, download *rate.Limiter
+	refs             int
+}
+
+// ShaperStats are counters of a Shaper.
+type ShaperStats struct {
+	// Waiting is the number of reads being delayed now.
+	Waiting int64
+	// Waits is the number of reads ever delayed.
+	Waits int64
+}
+
+func NewShaper(cfg ShaperConfig) *Shaper {
+	now := time.Now()
+	return &Shaper{
+		cfg:      cfg,
+		upload:   cfg.Upload.limiter(now),
+		download: cfg.Download.limiter(now),
+		clients:  map[string]*clientBuckets{},
+		now:      time.Now,
+		after:    time.After,
+	}
+}
+
+func (s *Shaper) Config() ShaperConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// SetConfig changes the bandwidth, including sessions already started.
+func (s *Shaper) SetConfig(cfg ShaperConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	now := s.now()
+	cfg.Upload.set(s.upload, now)
+	cfg.Download.set(s.download, now)
+	for _, c := range s.clients {
+		cfg.ClientUpload.set(c.upload, now)
+		cfg.ClientDownload.set(c.download, now)
+	}
+}
+
+func (s *Shaper) Stats() ShaperStats {
+	return ShaperStats{
+		Waiting: atomic.LoadInt64(&s.waiting),
+		Waits:   atomic.LoadInt64(&s.waits),
+	}
+}
+
+func (s *Shaper) acquire(client string) *clientBuckets {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[client]
+	if !ok {
+		now := s.now()
+		c = &clientBuckets{
+			upload:   s.cfg.ClientUpload.limiter(now),
+			download: s.cfg.ClientDownload.limiter(now),
+		}
+		s.clients[client] = c
+	}
+	c.refs++
+	return c
+}
+
+func (s *Shaper) release(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.clients[client]; c != nil {
+		if c.refs--; c.refs <= 0 {
+			delete(s.clients, client)
+		}
+	}
+}
+
+// chunk returns how many bytes can be taken from limiters at once.
+func chunk(limiters []*rate.Limiter, n int) int {
+	for _, l := range limiters {
+		if l.Limit() != rate.Inf && l.Burst() < n {
+			n = l.Burst()
+		}
+	}
+	return n
+}
+
+// wait waits until n bytes are available in all limiters.
+func (s *Shaper) wait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	now := s.now()
+	var delay time.Duration
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	cancel := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	for _, l := range limiters {
+		r := l.ReserveN(now, n)
+		if !r.OK() {
+			cancel()
+			return errors.New("bandwidth burst is changed")
+		}
+		reservations = append(reservations, r)
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&s.waits, 1)
+	atomic.AddInt64(&s.waiting, 1)
+	defer atomic.AddInt64(&s.waiting, -1)
+	select {
+	case <-s.after(delay):
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+// take waits until n bytes are taken from limiters, in parts of at most a
+// burst. Reads aren't made smaller than asked to take less at once, which
+// would truncate datagrams.
+func (s *Shaper) take(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for n > 0 {
+		part := chunk(limiters, n)
+		if err := s.wait(ctx, limiters, part); err != nil {
+			return err
+		}
+		n -= part
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zhsj/wghttp/internal/relay"
+)
+
+type connCounter struct {
+	active, total int64
+
+	mu    sync.Mutex
+	conns map[*countedConn]struct{}
+	// idle is closed and renewed when there's no active connection.
+	idle chan struct{}
+}
+
+func (c *connCounter) add(conn *countedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = map[*countedConn]struct{}{}
+	}
+	c.conns[conn] = struct{}{}
+	atomic.AddInt64(&c.active, 1)
+	atomic.AddInt64(&c.total, 1)
+}
+
+func (c *connCounter) remove(conn *countedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+	if atomic.AddInt64(&c.active, -1) == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// wait returns a channel which is closed when there's no active connection.
+func (c *connCounter) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.conns) == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	return c.idle
+}
+
+// closeAll closes all active connections, and returns how many are closed.
+func (c *connCounter) closeAll() int {
+	c.mu.Lock()
+	conns := make([]*countedConn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// countedListener counts connections accepted from it.
+type countedListener struct {
+	net.Listener
+	counter *connCounter
+}
+
+func (l *countedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := &countedConn{Conn: c, counter: l.counter}
+	l.counter.add(conn)
+	return conn, nil
+}
+
+type countedConn struct {
+	net.Conn
+	counter *connCounter
+	once    sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.counter.remove(c) })
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *countedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *countedConn) CloseWrite() error { return relay.CloseWrite(c.Conn) }
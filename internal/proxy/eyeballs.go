@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Address families tried first by Happy Eyeballs.
+const (
+	PreferAuto = "auto"
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// connectionAttemptDelay is the time to wait for an attempt before starting
+// the next one, see RFC 8305 section 5.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// sortAddrs interleaves ips by address family, starting with the preferred
+// one. PreferAuto starts with the family of the first address, as the
+// resolver sorts them following RFC 6724, see RFC 8305 section 4.
+func sortAddrs(ips []netip.Addr, prefer string) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		if ip = ip.Unmap(); ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if prefer == PreferIPv4 || (prefer == PreferAuto && len(ips) > 0 && ips[0].Unmap().Is4()) {
+		first, second = v4, v6
+	}
+
+	sorted := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialError reports the failure of every address.
+type dialError struct {
+	addrs []string
+	errs  []error
+}
+
+func (e *dialError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = e.addrs[i] + ": " + err.Error()
+	}
+	return "all addresses failed: " + strings.Join(msgs, "; ")
+}
+
+// Is and As check the error of every address, errors.Is and errors.As don't
+// look into multiple errors before Go 1.20.
+func (e *dialError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *dialError) As(target any) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialParallel dials addrs in order, starting the next attempt when the
+// previous one fails or takes longer than connectionAttemptDelay, and
+// returns the first connection established. after is time.After, except in
+// tests.
+func dialParallel(ctx context.Context, dial dialer, network string, addrs []string, after func(time.Duration) <-chan time.Time) (net.Conn, error) {
+	switch len(addrs) {
+	case 0:
+		return nil, errors.New("no addresses")
+	case 1:
+		return dial(ctx, network, addrs[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i    int
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	next, pending := 0, 0
+	var stagger <-chan time.Time
+	start := func() {
+		i := next
+		next++
+		pending++
+		stagger = after(connectionAttemptDelay)
+		go func() {
+			conn, err := dial(ctx, network, addrs[i])
+			select {
+			case results <- result{i: i, conn: conn, err: err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	errs := make([]error, len(addrs))
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			errs[r.i] = r.err
+			if next < len(addrs) {
+				start()
+			}
+		case <-stagger:
+			if next < len(addrs) {
+				start()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	dialed := &dialError{}
+	for i, err := range errs[:next] {
+		if err != nil {
+			dialed.addrs = append(dialed.addrs, addrs[i])
+			dialed.errs = append(dialed.errs, err)
+		}
+	}
+	return nil, dialed
+}
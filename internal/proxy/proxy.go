@@ -2,10 +2,23 @@ package proxy
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/zhsj/wghttp/internal/limit"
+	"github.com/zhsj/wghttp/internal/relay"
 	"github.com/zhsj/wghttp/internal/resolver"
 	"github.com/zhsj/wghttp/internal/third_party/tailscale/httpproxy"
 	"github.com/zhsj/wghttp/internal/third_party/tailscale/proxymux"
@@ -14,10 +27,103 @@ import (
 
 type dialer func(ctx context.Context, network, address string) (net.Conn, error)
 
+// dialTimeout bounds dialing for forwarded connections, the same as SOCKS5.
+const dialTimeout = 5 * time.Second
+
 type Proxy struct {
-	Dial  dialer
-	DNS   string
+	Dial dialer
+	// DNS resolves domains, with the system resolver by default.
+	DNS resolver.Config
+	// Prefer is the address family dialed first, one of PreferAuto,
+	// PreferIPv4 and PreferIPv6.
+	Prefer string
+	// Stats is served on /stats of the HTTP proxy if set.
 	Stats func() (any, error)
+	// IdleTimeout and MaxDuration bound proxied sessions and HTTP
+	// requests, zero means no limit.
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+	// Users are names and passwords required by the HTTP and SOCKS5 proxy
+	// if not empty. Clients are told apart by their user names then, and by
+	// their IPs otherwise.
+	Users map[string]string
+	// MaxConns and MaxConnsPerClient limit concurrent proxied sessions,
+	// zero means no limit.
+	MaxConns          int
+	MaxConnsPerClient int
+	// Shaper optionally limits bandwidth of proxied sessions.
+	Shaper *limit.Shaper
+	// Accounting optionally records traffic of proxied sessions and
+	// enforces quotas.
+	Accounting *limit.Accounting
+	// Upstreams are proxies to chain to by name, which are selected by
+	// Routes in order.
+	Upstreams map[string]*url.URL
+	Routes    []Route
+	// TLSConfig enables HTTPS proxy on the same listener if set, which
+	// also serves HTTP/2. HTTP/2 without TLS is always served.
+	TLSConfig *tls.Config
+	// ConnectUDP enables CONNECT-UDP of RFC 9298 over HTTP/1.1.
+	ConnectUDP bool
+	// Forward configures proxying of plain HTTP requests.
+	Forward httpproxy.Forward
+
+	conns connCounter
+
+	setupOnce sync.Once
+	dial      dialer
+	policy    *limit.Policy
+	setupErr  error
+
+	mu        sync.Mutex
+	lns       []net.Listener
+	httpProxy *http.Server
+	resolv    *resolver.Resolver
+	limiter   *limit.Limiter
+	closing   bool
+}
+
+// ErrClosed is returned by Serve after Shutdown.
+var ErrClosed = errors.New("proxy: closed")
+
+// Counters are stats of the proxy itself.
+type Counters struct {
+	ActiveConnections int64
+	TotalConnections  int64
+	// Lookups of DNS, those answered by static hosts among them, and
+	// failed ones.
+	DNSLookups   int64
+	DNSHostsHits int64
+	DNSFailures  int64
+	// Sessions refused by MaxConns and MaxConnsPerClient.
+	RejectedByGlobalLimit int64
+	RejectedByClientLimit int64
+	// Reads delayed by Shaper, now and in total.
+	Throttling    int64
+	ThrottleWaits int64
+}
+
+func (p *Proxy) Counters() Counters {
+	c := Counters{
+		ActiveConnections: atomic.LoadInt64(&p.conns.active),
+		TotalConnections:  atomic.LoadInt64(&p.conns.total),
+	}
+	p.mu.Lock()
+	resolv, limiter := p.resolv, p.limiter
+	p.mu.Unlock()
+	if resolv != nil {
+		s := resolv.Stats()
+		c.DNSLookups, c.DNSHostsHits, c.DNSFailures = s.Lookups, s.HostsHits, s.Failures
+	}
+	if limiter != nil {
+		s := limiter.Stats()
+		c.RejectedByGlobalLimit, c.RejectedByClientLimit = s.RejectedGlobal, s.RejectedClient
+	}
+	if p.Shaper != nil {
+		s := p.Shaper.Stats()
+		c.Throttling, c.ThrottleWaits = s.Waiting, s.Waits
+	}
+	return c
 }
 
 func statsHandler(next http.Handler, stats func() (any, error)) http.Handler {
@@ -37,18 +143,16 @@ func statsHandler(next http.Handler, stats func() (any, error)) http.Handler {
 	})
 }
 
-func dialWithDNS(dial dialer, dns string) dialer {
-	resolv := resolver.New(dns, dial)
-
+// dialWithResolver resolves domains with resolv, and dials the addresses
+// with Happy Eyeballs, starting with the family of prefer.
+func dialWithResolver(dial dialer, resolv *resolver.Resolver, prefer string) dialer {
 	return func(ctx context.Context, network, address string) (net.Conn, error) {
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
 			return nil, err
 		}
-		if err == nil {
-			if ip := net.ParseIP(host); ip != nil {
-				return dial(ctx, network, address)
-			}
+		if ip := net.ParseIP(host); ip != nil {
+			return dial(ctx, network, address)
 		}
 
 		ips, err := resolv.LookupNetIP(ctx, network, host)
@@ -56,39 +160,220 @@ func dialWithDNS(dial dialer, dns string) dialer {
 			return nil, err
 		}
 
-		var (
-			lastErr error
-			conn    net.Conn
-		)
-		for _, ip := range ips {
-			addr := net.JoinHostPort(ip.String(), port)
-			conn, lastErr = dial(ctx, network, addr)
-			if lastErr == nil {
-				return conn, nil
-			}
+		var addrs []string
+		for _, ip := range sortAddrs(ips, prefer) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
 		}
-		return nil, lastErr
+		return dialParallel(ctx, dial, network, addrs, time.After)
 	}
 }
 
-func (p Proxy) Serve(ln net.Listener) {
-	d := dialWithDNS(p.Dial, p.DNS)
+// setup builds the dialer and the policy of sessions shared by all
+// listeners.
+func (p *Proxy) setup() (dialer, error) {
+	p.setupOnce.Do(func() {
+		resolv := resolver.NewWithConfig(p.DNS, p.Dial)
+		limiter := &limit.Limiter{Max: p.MaxConns, MaxPerClient: p.MaxConnsPerClient}
+		d, err := dialWithRoutes(dialWithResolver(p.Dial, resolv, p.Prefer), p.Upstreams, p.Routes)
+		if err != nil {
+			p.setupErr = err
+			return
+		}
+		p.dial = d
+		p.policy = &limit.Policy{Limiter: limiter, Shaper: p.Shaper, Accounting: p.Accounting}
 
-	socksListener, httpListener := proxymux.SplitSOCKSAndHTTP(ln)
+		p.mu.Lock()
+		p.resolv, p.limiter = resolv, limiter
+		p.mu.Unlock()
+	})
+	return p.dial, p.setupErr
+}
 
-	httpProxy := &http.Server{Handler: statsHandler(httpproxy.Handler(d), p.Stats)}
-	socksProxy := &socks5.Server{Dialer: d}
+// track adds ln to the listeners closed by Shutdown, and counts connections
+// accepted from it.
+func (p *Proxy) track(ln net.Listener) (net.Listener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		ln.Close()
+		return nil, ErrClosed
+	}
+	p.lns = append(p.lns, ln)
+	return &countedListener{Listener: ln, counter: &p.conns}, nil
+}
+
+func (p *Proxy) relayConfig() relay.Config {
+	return relay.Config{IdleTimeout: p.IdleTimeout, MaxDuration: p.MaxDuration}
+}
 
-	errc := make(chan error, 2)
+// authenticate checks credentials against Users, it's nil if there are no
+// users.
+func (p *Proxy) authenticate() func(user, password string) bool {
+	if len(p.Users) == 0 {
+		return nil
+	}
+	return func(user, password string) bool {
+		want, ok := p.Users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	}
+}
+
+// Serve serves HTTP and SOCKS5 proxy on ln, until ln fails or Shutdown is
+// called.
+func (p *Proxy) Serve(ln net.Listener) error {
+	d, err := p.setup()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	handler := httpproxy.Handler(d, httpproxy.Config{
+		Relay:        p.relayConfig(),
+		ConnectUDP:   p.ConnectUDP,
+		Forward:      p.Forward,
+		Authenticate: p.authenticate(),
+		Policy:       p.policy,
+	})
+	if p.Stats != nil {
+		handler = statsHandler(handler, p.Stats)
+	}
+	h2Server := &http2.Server{}
+	handler = h2c.NewHandler(handler, h2Server)
+	httpProxy := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: p.IdleTimeout,
+		IdleTimeout:       p.IdleTimeout,
+		ReadTimeout:       p.MaxDuration,
+		WriteTimeout:      p.MaxDuration,
+		ConnContext:       limit.WithClient,
+	}
+	if p.TLSConfig != nil {
+		httpProxy.TLSConfig = p.TLSConfig.Clone()
+	}
+	if err := http2.ConfigureServer(httpProxy, h2Server); err != nil {
+		ln.Close()
+		return err
+	}
+	socksProxy := &socks5.Server{
+		Dialer:       d,
+		Relay:        p.relayConfig(),
+		ConnContext:  limit.WithClient,
+		Authenticate: p.authenticate(),
+		Policy:       p.policy,
+	}
+
+	p.mu.Lock()
+	p.httpProxy = httpProxy
+	p.mu.Unlock()
+	ln, err = p.track(ln)
+	if err != nil {
+		return err
+	}
+	var socksListener, httpListener, tlsListener net.Listener
+	if p.TLSConfig != nil {
+		socksListener, httpListener, tlsListener = proxymux.SplitSOCKSHTTPAndTLS(ln)
+	} else {
+		socksListener, httpListener = proxymux.SplitSOCKSAndHTTP(ln)
+	}
+
+	errc := make(chan error, 3)
 	go func() {
-		if err := httpProxy.Serve(httpListener); err != nil {
-			errc <- err
-		}
+		errc <- httpProxy.Serve(httpListener)
 	}()
+	if tlsListener != nil {
+		go func() {
+			errc <- httpProxy.Serve(tls.NewListener(tlsListener, httpProxy.TLSConfig))
+		}()
+	}
 	go func() {
-		if err := socksProxy.Serve(socksListener); err != nil {
-			errc <- err
-		}
+		errc <- socksProxy.Serve(socksListener)
 	}()
-	<-errc
+	err = <-errc
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		return ErrClosed
+	}
+	return err
+}
+
+// ServeForward forwards connections accepted on ln to the address returned
+// by target, until ln fails or Shutdown is called. target may read from c,
+// and returns the connection to read from instead in that case.
+func (p *Proxy) ServeForward(ln net.Listener, target func(c net.Conn) (string, net.Conn, error), logf func(format string, args ...any)) error {
+	d, err := p.setup()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	ln, err = p.track(ln)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.closing {
+				return ErrClosed
+			}
+			return err
+		}
+		go func() {
+			defer c.Close()
+			addr, src, err := target(c)
+			if err != nil {
+				logf("Forward %s: %v", c.RemoteAddr(), err)
+				return
+			}
+			ctx := limit.WithClient(context.Background(), c)
+			sess, err := p.policy.Start(ctx)
+			if err != nil {
+				logf("Forward %s to %s: %v", c.RemoteAddr(), addr, err)
+				return
+			}
+			defer sess.End()
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			dst, err := d(ctx, "tcp", addr)
+			cancel()
+			if err != nil {
+				logf("Forward %s to %s: %v", c.RemoteAddr(), addr, err)
+				return
+			}
+			defer dst.Close()
+			if err := p.relayConfig().PipeMetered(c, src, dst, sess); err != nil {
+				logf("Forward %s to %s: %v", c.RemoteAddr(), addr, err)
+			}
+		}()
+	}
+}
+
+// Shutdown stops accepting connections, and waits for active connections to
+// finish. When ctx is done, the remaining connections are closed forcibly.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closing = true
+	lns, httpProxy := p.lns, p.httpProxy
+	p.mu.Unlock()
+
+	for _, ln := range lns {
+		ln.Close()
+	}
+	if httpProxy != nil {
+		// It closes idle keep-alive connections, hijacked CONNECT tunnels
+		// are waited below.
+		go func() { _ = httpProxy.Shutdown(ctx) }()
+	}
+
+	select {
+	case <-p.conns.wait():
+		return nil
+	case <-ctx.Done():
+		n := p.conns.closeAll()
+		return fmt.Errorf("%w, closed %d connections", ctx.Err(), n)
+	}
 }
@@ -1,10 +1,25 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+
+	"github.com/zhsj/wghttp/internal/resolver"
+	"github.com/zhsj/wghttp/internal/third_party/tailscale/socks5"
 )
 
 func TestDialWithDNS(t *testing.T) {
@@ -20,11 +35,12 @@ func TestDialWithDNS(t *testing.T) {
 		},
 	}
 
-	// d := dialWithDNS(stdDiar.DialContext, "https://223.5.5.5")
-	d := dialWithDNS(func(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
 		t.Logf("dial to %s:%s", network, address)
 		return stdDiar.DialContext(ctx, network, address)
-	}, "tls://223.5.5.5")
+	}
+	// d := dialWithResolver(dial, resolver.New("https://223.5.5.5", dial), PreferAuto)
+	d := dialWithResolver(dial, resolver.New("tls://223.5.5.5", dial), PreferAuto)
 
 	for _, addr := range []string{
 		"example.com:80",
@@ -43,3 +59,350 @@ func TestDialWithDNS(t *testing.T) {
 		})
 	}
 }
+
+func TestRouteMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"*", "example.com", true},
+		{"example.com", "example.com", true},
+		{"example.com", "www.Example.com.", true},
+		{"*.example.com", "www.example.com", true},
+		{".example.com", "example.com", true},
+		{"example.com", "badexample.com", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+		{"10.0.0.0/8", "example.com", false},
+		{"2001:db8::1", "2001:db8::1", true},
+	} {
+		if got := (Route{Pattern: tc.pattern}).match(tc.host); got != tc.want {
+			t.Errorf("Route{%q}.match(%q) = %v, want %v", tc.pattern, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestDialWithRoutes(t *testing.T) {
+	// The destination echoes a line.
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	go func() {
+		for {
+			c, err := dst.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				_, _ = c.Write([]byte(line))
+			}()
+		}
+	}()
+
+	// An HTTP proxy requiring auth, which only connects to dst.
+	var connected []string
+	var mu sync.Mutex
+	httpUpstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			http.Error(rw, "auth", http.StatusProxyAuthRequired)
+			return
+		}
+		mu.Lock()
+		connected = append(connected, r.Host)
+		mu.Unlock()
+		c, err := net.Dial("tcp", dst.Addr().String())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		cc, _, _ := rw.(http.Hijacker).Hijack()
+		_, _ = cc.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go func() { _, _ = io.Copy(c, cc) }()
+		_, _ = io.Copy(cc, c)
+		cc.Close()
+		c.Close()
+	}))
+	defer httpUpstream.Close()
+
+	// A SOCKS5 proxy.
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksLn.Close()
+	go func() { _ = (&socks5.Server{Logf: t.Logf}).Serve(socksLn) }()
+
+	direct := (&net.Dialer{}).DialContext
+	upstreams := map[string]*url.URL{
+		"corp":   {Scheme: "http", Host: httpUpstream.Listener.Addr().String(), User: url.UserPassword("user", "pass")},
+		"noauth": {Scheme: "http", Host: httpUpstream.Listener.Addr().String()},
+		"socks":  {Scheme: "socks5", Host: socksLn.Addr().String()},
+	}
+	_, port, _ := net.SplitHostPort(dst.Addr().String())
+	d, err := dialWithRoutes(direct, upstreams, []Route{
+		{Pattern: "corp.example", Upstream: "corp"},
+		{Pattern: "denied.example", Upstream: "noauth"},
+		{Pattern: "127.0.0.0/8", Upstream: "socks"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		addr    string
+		wantErr bool
+	}{
+		{"www.corp.example:" + port, false},
+		{"denied.example:" + port, true},
+		{dst.Addr().String(), false},
+	} {
+		c, err := d(context.Background(), "tcp", tc.addr)
+		if tc.wantErr {
+			if err == nil {
+				c.Close()
+				t.Errorf("dial %s: want error", tc.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("dial %s: %v", tc.addr, err)
+			continue
+		}
+		_, _ = c.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(c).ReadString('\n')
+		c.Close()
+		if line != "hello\n" {
+			t.Errorf("dial %s: got %q, %v", tc.addr, line, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(connected) != 1 || connected[0] != "www.corp.example:"+port {
+		t.Errorf("HTTP upstream got CONNECT to %v", connected)
+	}
+
+	if _, err := dialWithRoutes(direct, upstreams, []Route{{Pattern: "*", Upstream: "unknown"}}); err == nil {
+		t.Error("dialWithRoutes() with unknown upstream: want error")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	go func() {
+		for {
+			c, err := dst.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Dial:              (&net.Dialer{}).DialContext,
+		Users:             map[string]string{"alice": "secret", "bob": "hunter2"},
+		MaxConnsPerClient: 1,
+	}
+	go func() { _ = p.Serve(ln) }()
+	defer p.Shutdown(context.Background())
+
+	connect := func(user, password string) (net.Conn, int) {
+		t.Helper()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := "CONNECT " + dst.Addr().String() + " HTTP/1.1\r\nHost: " + dst.Addr().String() + "\r\n"
+		if user != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)) + "\r\n"
+		}
+		_, _ = io.WriteString(c, req+"\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, resp.StatusCode
+	}
+	socks := func(user, password string) (net.Conn, error) {
+		d, err := xproxy.SOCKS5("tcp", ln.Addr().String(), &xproxy.Auth{User: user, Password: password}, xproxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Dial("tcp", dst.Addr().String())
+	}
+
+	if c, code := connect("", ""); code != http.StatusProxyAuthRequired {
+		t.Errorf("CONNECT without user: got %d", code)
+		c.Close()
+	}
+	if c, code := connect("alice", "wrong"); code != http.StatusProxyAuthRequired {
+		t.Errorf("CONNECT with wrong password: got %d", code)
+		c.Close()
+	}
+	alice, code := connect("alice", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("CONNECT as alice: got %d", code)
+	}
+	// The limit is per user, not per IP.
+	if c, err := socks("alice", "secret"); err == nil {
+		t.Error("SOCKS5 as alice over limit: want error")
+		c.Close()
+	}
+	bob, err := socks("bob", "hunter2")
+	if err != nil {
+		t.Fatalf("SOCKS5 as bob: %v", err)
+	}
+	bob.Close()
+	if c, err := socks("bob", "wrong"); err == nil {
+		t.Error("SOCKS5 with wrong password: want error")
+		c.Close()
+	}
+
+	alice.Close()
+	// The session ends after the tunnel is closed.
+	for i := 0; ; i++ {
+		c, err := socks("alice", "secret")
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("SOCKS5 as alice after closing: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSortAddrs(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("::ffff:192.0.2.4"),
+		netip.MustParseAddr("2001:db8::2"),
+	}
+	// The resolver puts IPv6 first.
+	ips6 := append([]netip.Addr{ips[5]}, ips[:5]...)
+	for _, tc := range []struct {
+		ips    []netip.Addr
+		prefer string
+		want   string
+	}{
+		{ips, PreferAuto, "[192.0.2.1 2001:db8::1 192.0.2.2 2001:db8::2 192.0.2.3 192.0.2.4]"},
+		{ips6, PreferAuto, "[2001:db8::2 192.0.2.1 2001:db8::1 192.0.2.2 192.0.2.3 192.0.2.4]"},
+		{ips, PreferIPv6, "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 192.0.2.3 192.0.2.4]"},
+		{ips6, PreferIPv4, "[192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::1 192.0.2.3 192.0.2.4]"},
+	} {
+		if got := fmt.Sprint(sortAddrs(tc.ips, tc.prefer)); got != tc.want {
+			t.Errorf("sortAddrs(%v, %s) = %s, want %s", tc.ips, tc.prefer, got, tc.want)
+		}
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	// Dialing IPv6 hangs until canceled, 192.0.2.1 succeeds, and others
+	// fail. Attempts are reported, and the attempt delay only passes when
+	// the test sends to delay.
+	attempts, canceled := make(chan string, 10), make(chan string, 10)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		attempts <- address
+		host, _, _ := net.SplitHostPort(address)
+		switch ip := netip.MustParseAddr(host); {
+		case ip.Is6():
+			<-ctx.Done()
+			canceled <- address
+			return nil, ctx.Err()
+		case ip == netip.MustParseAddr("192.0.2.1"):
+			c, _ := net.Pipe()
+			return c, nil
+		}
+		return nil, fmt.Errorf("refused")
+	}
+	delay := make(chan time.Time)
+	after := func(d time.Duration) <-chan time.Time {
+		if d != connectionAttemptDelay {
+			t.Errorf("waited for %s, want %s", d, connectionAttemptDelay)
+		}
+		return delay
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	dialAsync := func(addrs ...string) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			c, err := dialParallel(context.Background(), dial, "tcp", addrs, after)
+			done <- result{c, err}
+		}()
+		return done
+	}
+	// receive fails instead of hanging when something doesn't happen.
+	receive := func(ch <-chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s", want)
+		}
+	}
+	wait := func(done <-chan result) result {
+		t.Helper()
+		select {
+		case r := <-done:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("dialParallel doesn't return")
+			return result{}
+		}
+	}
+
+	// A hanging attempt is followed by the next one after the delay, and
+	// canceled when that one connects.
+	done := dialAsync("[2001:db8::1]:80", "192.0.2.1:80")
+	receive(attempts, "[2001:db8::1]:80")
+	if len(attempts) != 0 {
+		t.Errorf("next attempt before the delay: %s", <-attempts)
+	}
+	delay <- time.Time{}
+	receive(attempts, "192.0.2.1:80")
+	r := wait(done)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.conn.Close()
+	receive(canceled, "[2001:db8::1]:80")
+
+	// A failed attempt is followed by the next one without waiting.
+	r = wait(dialAsync("192.0.2.2:80", "192.0.2.1:80"))
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.conn.Close()
+	receive(attempts, "192.0.2.2:80")
+	receive(attempts, "192.0.2.1:80")
+
+	r = wait(dialAsync("192.0.2.2:80", "192.0.2.3:80"))
+	if r.err == nil || !strings.Contains(r.err.Error(), "192.0.2.2:80: refused") || !strings.Contains(r.err.Error(), "192.0.2.3:80: refused") {
+		t.Errorf("got error %v, want failures of every address", r.err)
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zhsj/wghttp/internal/relay"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Route sends connections to destinations matching Pattern through the
+// upstream proxy named Upstream, or directly if Upstream is "direct".
+//
+// Pattern is "*" for all destinations, an IP, a CIDR like 10.0.0.0/8, or a
+// domain which also matches its subdomains.
+type Route struct {
+	Pattern  string
+	Upstream string
+}
+
+const directUpstream = "direct"
+
+func (r Route) match(host string) bool {
+	return MatchHost(r.Pattern, host)
+}
+
+// MatchHost reports whether host matches pattern, in the format of
+// Route.Pattern.
+func MatchHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	ip, ipErr := netip.ParseAddr(host)
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		return ipErr == nil && prefix.Contains(ip.Unmap())
+	}
+	if pip, err := netip.ParseAddr(pattern); err == nil {
+		return ipErr == nil && pip == ip.Unmap()
+	}
+	domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// dialWithRoutes dials through upstream proxies according to routes, and
+// with direct otherwise. Upstream proxies are dialed with direct too.
+func dialWithRoutes(direct dialer, upstreams map[string]*url.URL, routes []Route) (dialer, error) {
+	dialers := map[string]dialer{directUpstream: direct}
+	for name, u := range upstreams {
+		d, err := upstreamDialer(direct, u)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		dialers[name] = d
+	}
+	for _, r := range routes {
+		if _, ok := dialers[r.Upstream]; !ok {
+			return nil, fmt.Errorf("route %s: unknown upstream %s", r.Pattern, r.Upstream)
+		}
+	}
+	if len(routes) == 0 {
+		return direct, nil
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			if r.match(host) {
+				return dialers[r.Upstream](ctx, network, address)
+			}
+		}
+		return direct(ctx, network, address)
+	}, nil
+}
+
+func upstreamDialer(dial dialer, u *url.URL) (dialer, error) {
+	switch u.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			if network != "tcp" && network != "tcp4" && network != "tcp6" {
+				return nil, fmt.Errorf("network %s is not supported by HTTP upstream", network)
+			}
+			return dialHTTPConnect(ctx, dial, u, address)
+		}, nil
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &xproxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := xproxy.SOCKS5("tcp", u.Host, auth, contextDialer(dial))
+		if err != nil {
+			return nil, err
+		}
+		return d.(xproxy.ContextDialer).DialContext, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+}
+
+// contextDialer adapts a dialer to golang.org/x/net/proxy.
+type contextDialer dialer
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// dialHTTPConnect dials address through the HTTP proxy u with CONNECT.
+func dialHTTPConnect(ctx context.Context, dial dialer, u *url.URL, address string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+	c, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	} else {
+		_ = c.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	if u.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("upstream tls: %w", err)
+		}
+		c = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("upstream connect: %w", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("upstream connect: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("upstream connect: %s", resp.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn reads what's buffered first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error { return relay.CloseWrite(c.Conn) }
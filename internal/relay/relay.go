@@ -0,0 +1,196 @@
+// Package relay copies data between proxied connections, with idle timeout,
+// maximum session duration and half-close.
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrIdleTimeout = errors.New("idle timeout")
+	ErrMaxDuration = errors.New("maximum session duration reached")
+	ErrUnsupported = errors.New("not supported")
+)
+
+// Config bounds relayed sessions, zero values mean no limit.
+type Config struct {
+	// IdleTimeout closes a session when no bytes are copied in either
+	// direction for this time.
+	IdleTimeout time.Duration
+	// MaxDuration closes a session after this time.
+	MaxDuration time.Duration
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite closes the write side of c if it supports half-close, or
+// returns ErrUnsupported. Wrappers of net.Conn pass CloseWrite through with
+// it, so Pipe can half-close them.
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return ErrUnsupported
+}
+
+// Meter wraps what's read in both directions of a session, e.g. to shape
+// traffic. Upload is read from the client, and download from the server.
+type Meter interface {
+	Upload(r io.Reader) io.Reader
+	Download(r io.Reader) io.Reader
+}
+
+// Pipe copies data between client and server until both directions are
+// done. Data from the client is read from clientSrc if it's not nil, e.g.
+// when some bytes are buffered. When a side sends EOF, the write side of
+// the other one is closed, so the other direction keeps going.
+func (c Config) Pipe(client net.Conn, clientSrc io.Reader, server net.Conn) error {
+	return c.PipeMetered(client, clientSrc, server, nil)
+}
+
+// PipeMetered is Pipe with both directions read through m if it's not nil.
+func (c Config) PipeMetered(client net.Conn, clientSrc io.Reader, server net.Conn, m Meter) error {
+	if clientSrc == nil {
+		clientSrc = client
+	}
+	var serverSrc io.Reader = server
+	if m != nil {
+		clientSrc, serverSrc = m.Upload(clientSrc), m.Download(serverSrc)
+	}
+
+	var (
+		active    int64 // unix nano of the last copy
+		closeOnce sync.Once
+		reason    error
+	)
+	touch := func() { atomic.StoreInt64(&active, time.Now().UnixNano()) }
+	closeBoth := func(err error) {
+		closeOnce.Do(func() {
+			reason = err
+			client.Close()
+			server.Close()
+		})
+	}
+	touch()
+
+	done := make(chan struct{})
+	defer close(done)
+	if c.IdleTimeout > 0 || c.MaxDuration > 0 {
+		go c.watch(done, &active, closeBoth)
+	}
+
+	copyHalf := func(dst net.Conn, src io.Reader) error {
+		var r io.Reader = &touchReader{Reader: src, touch: touch}
+		if _, ok := src.(io.WriterTo); ok {
+			r = touchWriterTo{r.(*touchReader)}
+		}
+		_, err := io.Copy(dst, r)
+		if err != nil {
+			closeBoth(nil)
+			return err
+		}
+		if CloseWrite(dst) == nil {
+			return nil
+		}
+		closeBoth(nil)
+		return nil
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		err := copyHalf(client, serverSrc)
+		if err != nil {
+			err = fmt.Errorf("from backend to client: %w", err)
+		}
+		errc <- err
+	}()
+	go func() {
+		err := copyHalf(server, clientSrc)
+		if err != nil {
+			err = fmt.Errorf("from client to backend: %w", err)
+		}
+		errc <- err
+	}()
+	err1, err2 := <-errc, <-errc
+
+	// The reason is set before closing, which makes copying fail.
+	closeOnce.Do(func() {})
+	if reason != nil {
+		return reason
+	}
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+func (c Config) watch(done <-chan struct{}, active *int64, closeBoth func(error)) {
+	var maxC <-chan time.Time
+	if c.MaxDuration > 0 {
+		t := time.NewTimer(c.MaxDuration)
+		defer t.Stop()
+		maxC = t.C
+	}
+	var idle *time.Timer
+	var idleC <-chan time.Time
+	if c.IdleTimeout > 0 {
+		idle = time.NewTimer(c.IdleTimeout)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-maxC:
+			closeBoth(ErrMaxDuration)
+			return
+		case <-idleC:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(active)))
+			if since >= c.IdleTimeout {
+				closeBoth(ErrIdleTimeout)
+				return
+			}
+			idle.Reset(c.IdleTimeout - since)
+		}
+	}
+}
+
+type touchReader struct {
+	io.Reader
+	touch func()
+}
+
+func (r *touchReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
+
+// touchWriterTo is a touchReader of an io.WriterTo, whose WriteTo is kept,
+// e.g. to copy whole datagrams.
+type touchWriterTo struct {
+	*touchReader
+}
+
+func (r touchWriterTo) WriteTo(w io.Writer) (int64, error) {
+	return r.Reader.(io.WriterTo).WriteTo(writerFunc(func(p []byte) (int, error) {
+		r.touch()
+		return w.Write(p)
+	}))
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	client, clientPeer := tcpPair(t)
+	server, serverPeer := tcpPair(t)
+	defer client.Close()
+	defer serverPeer.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- Config{}.Pipe(clientPeer, nil, server) }()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(serverPeer)
+	if err != nil || string(got) != "ping" {
+		t.Fatalf("server got %q, %v", got, err)
+	}
+	// The server can still reply after the client is done sending.
+	if _, err := serverPeer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	serverPeer.Close()
+
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("client got %q, %v", got, err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Pipe() = %v", err)
+	}
+}
+
+func TestPipeTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want error
+	}{
+		{Config{IdleTimeout: 100 * time.Millisecond}, ErrIdleTimeout},
+		{Config{MaxDuration: 300 * time.Millisecond, IdleTimeout: time.Minute}, ErrMaxDuration},
+	} {
+		client, clientPeer := tcpPair(t)
+		server, serverPeer := tcpPair(t)
+
+		errc := make(chan error, 1)
+		go func() { errc <- tc.cfg.Pipe(clientPeer, nil, server) }()
+		// Keep the session busy for a while.
+		go func() {
+			for i := 0; i < 5; i++ {
+				if _, err := client.Write([]byte("x")); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		go func() { _, _ = io.Copy(io.Discard, serverPeer) }()
+
+		select {
+		case err := <-errc:
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Pipe() = %v, want %v", err, tc.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Pipe() doesn't return, want %v", tc.want)
+		}
+		client.Close()
+		serverPeer.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// ParseHosts parses hosts(5) file, and returns addresses of names.
+func ParseHosts(r io.Reader) (map[string][]netip.Addr, error) {
+	hosts := map[string][]netip.Addr{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: no host name", n)
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		for _, name := range fields[1:] {
+			if err := CheckHostName(name); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			name = normalizeName(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// CheckHostName returns an error if name is a wildcard or starts with a
+// dot, which would be an exact name after normalizeName, as static hosts
+// don't match subdomains.
+func CheckHostName(name string) error {
+	if strings.Contains(name, "*") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%q: wildcards aren't supported in static hosts", name)
+	}
+	return nil
+}
+
+// normalizeName returns name in lower case without the trailing dot, and
+// the leading "*." or ".".
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	name = strings.TrimPrefix(name, "*")
+	return strings.TrimPrefix(name, ".")
+}
+
+// lookupHosts returns static addresses of host in ipNetwork.
+func (r *Resolver) lookupHosts(ipNetwork, host string) []netip.Addr {
+	var ips []netip.Addr
+	for _, ip := range r.hosts[normalizeName(host)] {
+		switch {
+		case ipNetwork == "ip4" && !ip.Unmap().Is4():
+		case ipNetwork == "ip6" && ip.Unmap().Is4():
+		default:
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// forHost returns the resolver of the longest route matching host, or r
+// itself.
+func (r *Resolver) forHost(host string) *Resolver {
+	host = normalizeName(host)
+	best := r
+	bestLen := -1
+	for _, rt := range r.routes {
+		if (host == rt.suffix || strings.HasSuffix(host, "."+rt.suffix)) && len(rt.suffix) > bestLen {
+			best, bestLen = rt.r, len(rt.suffix)
+		}
+	}
+	return best
+}
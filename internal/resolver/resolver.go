@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/netip"
 	"strings"
+	"sync/atomic"
 )
 
 var errNotRetry = errors.New("not retry")
@@ -19,6 +20,50 @@ type Resolver struct {
 	httpClient    *http.Client
 
 	r *net.Resolver
+
+	hosts  map[string][]netip.Addr
+	routes []route
+
+	lookups, hostsHits, failures int64
+}
+
+type route struct {
+	suffix string
+	r      *Resolver
+}
+
+// Config configures a Resolver with static hosts and split DNS.
+type Config struct {
+	// DNS is the default server, in the format of New.
+	DNS string
+	// Routes send lookups of domains to other servers, the longest
+	// matching suffix wins.
+	Routes []Route
+	// Hosts are static addresses of names, which are looked up before
+	// DNS.
+	Hosts map[string][]netip.Addr
+}
+
+// Route sends lookups of Suffix and its subdomains to DNS.
+type Route struct {
+	Suffix string
+	DNS    string
+}
+
+// Stats are counters of lookups. Answers of DNS servers aren't cached, only
+// lookups answered by static hosts are not sent to a server.
+type Stats struct {
+	Lookups   int64
+	HostsHits int64
+	Failures  int64
+}
+
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		Lookups:   atomic.LoadInt64(&r.lookups),
+		HostsHits: atomic.LoadInt64(&r.hostsHits),
+		Failures:  atomic.LoadInt64(&r.failures),
+	}
 }
 
 func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
@@ -32,7 +77,30 @@ func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]net
 		ipNetwork = "ip6"
 	}
 
-	return r.r.LookupNetIP(ctx, ipNetwork, host)
+	atomic.AddInt64(&r.lookups, 1)
+	if ips := r.lookupHosts(ipNetwork, host); len(ips) > 0 {
+		atomic.AddInt64(&r.hostsHits, 1)
+		return ips, nil
+	}
+	ips, err := r.forHost(host).r.LookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		atomic.AddInt64(&r.failures, 1)
+	}
+	return ips, err
+}
+
+// NewWithConfig returns a Resolver of cfg, which dials servers with dial.
+func NewWithConfig(cfg Config, dial func(ctx context.Context, network, address string) (net.Conn, error)) *Resolver {
+	r := New(cfg.DNS, dial)
+	r.hosts = map[string][]netip.Addr{}
+	for name, ips := range cfg.Hosts {
+		name = normalizeName(name)
+		r.hosts[name] = append(r.hosts[name], ips...)
+	}
+	for _, rt := range cfg.Routes {
+		r.routes = append(r.routes, route{suffix: normalizeName(rt.Suffix), r: New(rt.DNS, dial)})
+	}
+	return r
 }
 
 func New(dns string, dial func(ctx context.Context, network, address string) (net.Conn, error)) *Resolver {
@@ -2,8 +2,13 @@ package resolver
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/netip"
+	"strings"
 	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestResolve(t *testing.T) {
@@ -37,3 +42,113 @@ func TestResolve(t *testing.T) {
 		})
 	}
 }
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# comment
+127.0.0.1 localhost
+10.0.0.1  git.corp Wiki.Corp. # inline comment
+10.0.0.2  git.corp
+::1       localhost
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"localhost": "[127.0.0.1 ::1]",
+		"git.corp":  "[10.0.0.1 10.0.0.2]",
+		"wiki.corp": "[10.0.0.1]",
+	}
+	if len(hosts) != len(want) {
+		t.Errorf("got %v, want %v", hosts, want)
+	}
+	for name, ips := range want {
+		if got := fmt.Sprint(hosts[name]); got != ips {
+			t.Errorf("hosts[%s] = %s, want %s", name, got, ips)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.1", "10.0.0.300 host", "10.0.0.1 *.corp", "10.0.0.1 .corp", "10.0.0.1 git.corp *"} {
+		if _, err := ParseHosts(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseHosts(%q): want error", bad)
+		}
+	}
+}
+
+func TestSplitDNS(t *testing.T) {
+	corp := serveDNS(t, netip.MustParseAddr("10.0.0.1"))
+	public := serveDNS(t, netip.MustParseAddr("192.0.2.1"))
+
+	r := NewWithConfig(Config{
+		DNS:    public,
+		Routes: []Route{{Suffix: "corp", DNS: corp}, {Suffix: "*.public.corp", DNS: public}},
+		Hosts: map[string][]netip.Addr{
+			"Pinned.example.com": {netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("2001:db8::1")},
+		},
+	}, (&net.Dialer{}).DialContext)
+
+	for _, tc := range []struct {
+		network, host string
+		want          string
+	}{
+		{"ip4", "git.corp", "[10.0.0.1]"},
+		{"ip4", "GIT.CORP.", "[10.0.0.1]"},
+		{"ip4", "corp", "[10.0.0.1]"},
+		{"ip4", "www.public.corp", "[192.0.2.1]"},
+		{"ip4", "example.com", "[192.0.2.1]"},
+		{"ip4", "notcorp", "[192.0.2.1]"},
+		{"ip", "pinned.example.com", "[198.51.100.1 2001:db8::1]"},
+		{"tcp4", "pinned.example.com", "[198.51.100.1]"},
+		{"ip6", "pinned.example.com", "[2001:db8::1]"},
+	} {
+		ips, err := r.LookupNetIP(context.Background(), tc.network, tc.host)
+		if err != nil {
+			t.Errorf("lookup %s %s: %v", tc.network, tc.host, err)
+			continue
+		}
+		if got := fmt.Sprint(ips); got != tc.want {
+			t.Errorf("lookup %s %s = %s, want %s", tc.network, tc.host, got, tc.want)
+		}
+	}
+	if s := r.Stats(); s.Lookups != 9 || s.HostsHits != 3 || s.Failures != 0 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+// serveDNS serves A records of ip for any name, and returns the address.
+func serveDNS(t *testing.T, ip netip.Addr) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			_ = b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: ip.As4()})
+			}
+			resp, _ := b.Finish()
+			_, _ = pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
@@ -0,0 +1,106 @@
+// Package sniff finds the destination of TLS and HTTP connections from the
+// server name of TLS ClientHello, or the Host header of HTTP request.
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout is the time to wait for the ClientHello or the request header.
+const Timeout = 10 * time.Second
+
+// recordTypeHandshake is the first byte of TLS ClientHello.
+const recordTypeHandshake = 0x16
+
+var errSniffed = errors.New("sniffed")
+
+// Host returns the server name of c, and a connection replaying what's read
+// from c. A port in the Host header is dropped, the destination port is up
+// to the caller.
+func Host(c net.Conn) (string, net.Conn, error) {
+	if err := c.SetReadDeadline(time.Now().Add(Timeout)); err != nil {
+		return "", nil, err
+	}
+	buf := &bytes.Buffer{}
+	host, err := sniff(io.TeeReader(c, buf))
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return "", nil, err
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return "", nil, errors.New("no server name")
+	}
+	return host, &replayConn{Conn: c, r: io.MultiReader(buf, c)}, nil
+}
+
+func sniff(r io.Reader) (string, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return "", err
+	}
+	r = io.MultiReader(bytes.NewReader(first), r)
+
+	if first[0] == recordTypeHandshake {
+		return serverName(r)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return "", fmt.Errorf("read HTTP request: %w", err)
+	}
+	req.Body.Close()
+	return req.Host, nil
+}
+
+// serverName reads the SNI of ClientHello from r.
+func serverName(r io.Reader) (string, error) {
+	var name string
+	sniffed := false
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name, sniffed = hello.ServerName, true
+			return nil, errSniffed
+		},
+	}).Handshake()
+	if !sniffed {
+		return "", fmt.Errorf("read TLS ClientHello: %w", err)
+	}
+	return name, nil
+}
+
+// readOnlyConn reads from r, and discards writes, for crypto/tls to parse
+// ClientHello.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
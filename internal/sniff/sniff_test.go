@@ -0,0 +1,95 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(c net.Conn)
+		want  string
+	}{
+		{
+			name: "tls",
+			write: func(c net.Conn) {
+				tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake()
+			},
+			want: "example.com",
+		},
+		{
+			name: "http",
+			write: func(c net.Conn) {
+				io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			},
+			want: "example.com",
+		},
+		{
+			name: "ipv6 http",
+			write: func(c net.Conn) {
+				io.WriteString(c, "GET / HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n")
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name: "http with port",
+			write: func(c net.Conn) {
+				io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n")
+			},
+			want: "example.com",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			sent := make(chan []byte, 1)
+			go func() {
+				rec := &recordConn{Conn: client}
+				tt.write(rec)
+				sent <- rec.written
+			}()
+
+			host, c, err := Host(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.want {
+				t.Errorf("got %s, want %s", host, tt.want)
+			}
+			// Closing unblocks the TLS client waiting for ServerHello.
+			client.Close()
+			want := <-sent
+			got, _ := io.ReadAll(c)
+			if string(got) != string(want) {
+				t.Errorf("replayed %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestHostNoServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	if _, _, err := Host(server); err == nil {
+		t.Error("want error without SNI")
+	}
+}
+
+type recordConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written = append(c.written, b[:n]...)
+	return n, err
+}
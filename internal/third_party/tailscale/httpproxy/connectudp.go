@@ -0,0 +1,232 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/zhsj/wghttp/internal/limit"
+	"github.com/zhsj/wghttp/internal/relay"
+)
+
+// connectUDPPrefix is the path of the default URI template in RFC 9298,
+// /.well-known/masque/udp/{target_host}/{target_port}/.
+const connectUDPPrefix = "/.well-known/masque/udp/"
+
+// capsuleDatagram is the type of DATAGRAM capsule in RFC 9297.
+const capsuleDatagram = 0x00
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+func isConnectUDP(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.ProtoMajor == 1 &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "connect-udp") &&
+		strings.HasPrefix(r.URL.Path, connectUDPPrefix)
+}
+
+// connectUDPTarget returns the target address in the path of r.
+func connectUDPTarget(r *http.Request) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, connectUDPPrefix), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] != "" {
+		return "", fmt.Errorf("bad CONNECT-UDP path %s", r.URL.Path)
+	}
+	return net.JoinHostPort(parts[0], parts[1]), nil
+}
+
+// serveConnectUDP relays UDP in DATAGRAM capsules over the upgraded
+// HTTP/1.1 connection.
+func serveConnectUDP(w http.ResponseWriter, r *http.Request, dialer func(ctx context.Context, netw, addr string) (net.Conn, error), cfg relay.Config, sess *limit.Session) {
+	dst, err := connectUDPTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := dialer(r.Context(), "udp", dst)
+	if err != nil {
+		w.Header().Set("Proxy-Status", fmt.Sprintf("wghttp; error=destination_unavailable; details=%q", err.Error()))
+		http.Error(w, err.Error(), dialErrorStatus(err, http.StatusBadGateway))
+		return
+	}
+	defer c.Close()
+
+	cc, ccbuf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cc.Close()
+
+	io.WriteString(cc, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: connect-udp\r\n"+
+		"Capsule-Protocol: ?1\r\n\r\n")
+
+	cfg.PipeMetered(&capsuleConn{Conn: cc, r: ccbuf.Reader}, nil, c, sess)
+}
+
+// capsuleConn reads and writes a UDP payload per DATAGRAM capsule, with
+// context ID 0.
+type capsuleConn struct {
+	net.Conn
+	r  *bufio.Reader
+	mu sync.Mutex
+}
+
+// Read reads the payload of the next DATAGRAM capsule, skipping other
+// capsules and contexts.
+func (c *capsuleConn) Read(b []byte) (int, error) {
+	for {
+		typ, _, err := readVarint(c.r)
+		if err != nil {
+			return 0, err
+		}
+		length, _, err := readVarint(c.r)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if typ != capsuleDatagram {
+			if _, err := c.r.Discard(int(length)); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			continue
+		}
+		if length == 0 {
+			return 0, errMalformedDatagram
+		}
+		id, n, err := readVarint(c.r)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if length < uint64(n) {
+			return 0, errMalformedDatagram
+		}
+		size := int(length) - n
+		if id != 0 || size > len(b) {
+			if _, err := c.r.Discard(size); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			if id == 0 {
+				return 0, io.ErrShortBuffer
+			}
+			continue
+		}
+		n, err = io.ReadFull(c.r, b[:size])
+		return n, unexpectedEOF(err)
+	}
+}
+
+// Write writes b as a DATAGRAM capsule.
+func (c *capsuleConn) Write(b []byte) (int, error) {
+	if len(b) > maxDatagramSize {
+		return 0, fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+	buf := make([]byte, 0, len(b)+16)
+	buf = appendVarint(buf, capsuleDatagram)
+	buf = appendVarint(buf, uint64(len(b)+1))
+	buf = appendVarint(buf, 0)
+	buf = append(buf, b...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom writes every read from r as a datagram, so large datagrams
+// aren't split by the buffer of io.Copy.
+func (c *capsuleConn) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, maxDatagramSize)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := c.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// WriteTo writes every datagram read to w, with a buffer large enough for
+// any of them, where io.Copy's smaller buffer fails with io.ErrShortBuffer.
+func (c *capsuleConn) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, maxDatagramSize)
+	var total int64
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (c *capsuleConn) CloseWrite() error { return relay.CloseWrite(c.Conn) }
+
+var errMalformedDatagram = errors.New("malformed DATAGRAM capsule")
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, which is only
+// expected between capsules.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readVarint reads a QUIC variable-length integer, see RFC 9000 section 16,
+// and returns its length too.
+func readVarint(r io.ByteReader) (uint64, int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, n, nil
+}
+
+// appendVarint appends v as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
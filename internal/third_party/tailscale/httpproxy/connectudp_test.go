@@ -0,0 +1,113 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	for _, tt := range []struct {
+		v    uint64
+		size int
+	}{
+		{0, 1},
+		{1<<6 - 1, 1},
+		{1 << 6, 2},
+		{1<<14 - 1, 2},
+		{1 << 14, 4},
+		{1<<30 - 1, 4},
+		{1 << 30, 8},
+		{1<<62 - 1, 8},
+	} {
+		b := appendVarint(nil, tt.v)
+		if len(b) != tt.size {
+			t.Errorf("appendVarint(%d) is %d bytes, want %d", tt.v, len(b), tt.size)
+		}
+		v, n, err := readVarint(bytes.NewReader(b))
+		if err != nil || v != tt.v || n != tt.size {
+			t.Errorf("readVarint(%x) = %d, %d, %v, want %d, %d", b, v, n, err, tt.v, tt.size)
+		}
+		if tt.size > 1 {
+			if _, _, err := readVarint(bytes.NewReader(b[:tt.size-1])); err != io.ErrUnexpectedEOF {
+				t.Errorf("readVarint(%x) = %v, want %v", b[:tt.size-1], err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+// capsule returns a capsule of typ with payload.
+func capsule(typ uint64, payload []byte) []byte {
+	b := appendVarint(nil, typ)
+	b = appendVarint(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// datagram returns a DATAGRAM capsule with context id.
+func datagram(id uint64, payload []byte) []byte {
+	return capsule(capsuleDatagram, append(appendVarint(nil, id), payload...))
+}
+
+// datagramRecorder records each write as a datagram.
+type datagramRecorder struct {
+	datagrams []string
+}
+
+func (r *datagramRecorder) Write(b []byte) (int, error) {
+	r.datagrams = append(r.datagrams, string(b))
+	return len(b), nil
+}
+
+func TestCapsuleConn(t *testing.T) {
+	large := strings.Repeat("x", 40000)
+	var stream []byte
+	stream = append(stream, capsule(0x2a, []byte("unknown"))...)
+	stream = append(stream, datagram(0, []byte("small"))...)
+	stream = append(stream, datagram(1, []byte("other context"))...)
+	stream = append(stream, datagram(0, []byte(large))...)
+	stream = append(stream, datagram(0, nil)...)
+	newConn := func(b []byte) *capsuleConn {
+		return &capsuleConn{r: bufio.NewReader(bytes.NewReader(b))}
+	}
+
+	// Read skips other capsules and contexts, but can't split datagrams.
+	c := newConn(stream)
+	buf := make([]byte, 32<<10)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "small" {
+		t.Errorf("Read() = %q, %v, want %q", buf[:n], err, "small")
+	}
+	if _, err := c.Read(buf); err != io.ErrShortBuffer {
+		t.Errorf("Read() of a large datagram = %v, want %v", err, io.ErrShortBuffer)
+	}
+
+	// WriteTo has a buffer for any datagram.
+	var rec datagramRecorder
+	n, err := newConn(stream).WriteTo(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"small", large}
+	if n != int64(len("small")+len(large)) || strings.Join(rec.datagrams, ",") != strings.Join(want, ",") {
+		t.Errorf("WriteTo() = %d, got %d datagrams, want %d", n, len(rec.datagrams), len(want))
+	}
+
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"length shorter than context id", capsule(capsuleDatagram, nil)},
+		{"truncated length", []byte{capsuleDatagram, 0x40}},
+		{"truncated payload", datagram(0, []byte("abc"))[:4]},
+		{"truncated other capsule", capsule(0x2a, []byte("abc"))[:3]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newConn(tt.stream).Read(buf)
+			if err == nil || errors.Is(err, io.EOF) {
+				t.Errorf("Read() = %v, want an error other than EOF", err)
+			}
+		})
+	}
+}
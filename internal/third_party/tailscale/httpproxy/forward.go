@@ -0,0 +1,200 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/zhsj/wghttp/internal/limit"
+	"github.com/zhsj/wghttp/internal/relay"
+)
+
+// hopHeaders are removed when forwarding, see RFC 9110 section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// director sets Via and X-Forwarded-For of r, which is to be sent by
+// httputil.ReverseProxy.
+func (f Forward) director(r *http.Request) {
+	f.addVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+	if !f.ForwardedFor {
+		// A nil value stops ReverseProxy from adding it.
+		r.Header["X-Forwarded-For"] = nil
+	}
+}
+
+func (f Forward) addVia(h http.Header, major, minor int) {
+	if f.Via {
+		h.Add("Via", fmt.Sprintf("%d.%d wghttp", major, minor))
+	}
+}
+
+func (f Forward) addForwardedFor(h http.Header, remoteAddr string) {
+	if !f.ForwardedFor {
+		h.Del("X-Forwarded-For")
+		return
+	}
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return
+	}
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	h.Set("X-Forwarded-For", ip)
+}
+
+// removeHopHeaders removes hop-by-hop headers of h, including those listed
+// in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// isUpgrade reports whether h asks for a protocol upgrade, e.g. WebSocket.
+func isUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(name), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade forwards a request to upgrade, e.g. to WebSocket, and relays
+// the upgraded connection like CONNECT tunnels.
+func serveUpgrade(w http.ResponseWriter, r *http.Request, dialer func(ctx context.Context, netw, addr string) (net.Conn, error), cfg Config, sess *limit.Session) {
+	if r.ProtoMajor != 1 {
+		http.Error(w, "upgrade is only supported in HTTP/1.1", http.StatusBadRequest)
+		return
+	}
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	c, err := dialer(r.Context(), "tcp", net.JoinHostPort(r.URL.Hostname(), port))
+	if err != nil {
+		http.Error(w, err.Error(), dialErrorStatus(err, http.StatusBadGateway))
+		return
+	}
+	if r.URL.Scheme == "https" {
+		c = tls.Client(c, &tls.Config{ServerName: r.URL.Hostname()})
+	}
+	defer c.Close()
+
+	upgrade := r.Header.Get("Upgrade")
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+	removeHopHeaders(outreq.Header)
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", upgrade)
+	cfg.Forward.addVia(outreq.Header, r.ProtoMajor, r.ProtoMinor)
+	cfg.Forward.addForwardedFor(outreq.Header, r.RemoteAddr)
+	if err := outreq.Write(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, outreq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	cfg.Forward.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		removeHopHeaders(resp.Header)
+		for k, vv := range resp.Header {
+			w.Header()[k] = vv
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, sess.Download(resp.Body))
+		return
+	}
+
+	cc, ccbuf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cc.Close()
+	if err := resp.Write(cc); err != nil {
+		return
+	}
+
+	var clientSrc io.Reader = ccbuf
+	if ccbuf.Reader.Buffered() == 0 {
+		clientSrc = cc
+	}
+	cfg.Relay.PipeMetered(cc, clientSrc, &bufferedConn{Conn: c, r: br}, sess)
+}
+
+type sessionKey struct{}
+
+// withSession returns r with sess in its context, and its body read through
+// sess, so the response can be read through sess by ModifyResponse too.
+func withSession(r *http.Request, sess *limit.Session) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, sess))
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &readCloser{Reader: sess.Upload(r.Body), Closer: r.Body}
+	}
+	return r
+}
+
+// downloadBody reads the body of resp through the session of its request.
+func downloadBody(resp *http.Response) {
+	sess, _ := resp.Request.Context().Value(sessionKey{}).(*limit.Session)
+	if sess != nil {
+		resp.Body = &readCloser{Reader: sess.Download(resp.Body), Closer: resp.Body}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferedConn reads from r, which buffers Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error { return relay.CloseWrite(c.Conn) }
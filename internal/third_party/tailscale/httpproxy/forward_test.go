@@ -0,0 +1,157 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"X-Hop, keep-alive", "X-Other-Hop"},
+		"X-Hop":               {"1"},
+		"X-Other-Hop":         {"1"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"Te":                  {"trailers"},
+		"Upgrade":             {"websocket"},
+		"X-End-To-End":        {"1"},
+	}
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("X-End-To-End") != "1" {
+		t.Errorf("removeHopHeaders() left %v, want only X-End-To-End", h)
+	}
+}
+
+func TestForward(t *testing.T) {
+	reqHeaders := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqHeaders <- r.Header
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		name    string
+		fwd     Forward
+		via     string
+		wantXFF string
+	}{
+		{"default", Forward{}, "", ""},
+		{"via and forwarded for", Forward{Via: true, ForwardedFor: true}, "1.1 wghttp", "198.51.100.1, 127.0.0.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var d net.Dialer
+			srv := httptest.NewServer(Handler(d.DialContext, Config{Forward: tt.fwd}))
+			defer srv.Close()
+			proxyURL, _ := url.Parse(srv.URL)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			defer client.CloseIdleConnections()
+
+			req, _ := http.NewRequest("GET", backend.URL, nil)
+			req.Header.Set("Connection", "X-Hop")
+			req.Header.Set("X-Hop", "1")
+			req.Header.Set("Proxy-Connection", "keep-alive")
+			req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+			req.Header.Set("X-Forwarded-For", "198.51.100.1")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+				t.Errorf("body = %q", body)
+			}
+
+			h := <-reqHeaders
+			for _, name := range []string{"X-Hop", "Proxy-Connection", "Proxy-Authorization"} {
+				if v := h.Get(name); v != "" {
+					t.Errorf("request %s = %q, want it removed", name, v)
+				}
+			}
+			if v := h.Get("Via"); v != tt.via {
+				t.Errorf("request Via = %q, want %q", v, tt.via)
+			}
+			if v := h.Get("X-Forwarded-For"); v != tt.wantXFF {
+				t.Errorf("request X-Forwarded-For = %q, want %q", v, tt.wantXFF)
+			}
+			if v := resp.Header.Get("X-Hop"); v != "" {
+				t.Errorf("response X-Hop = %q, want it removed", v)
+			}
+			if v := resp.Header.Get("Via"); v != tt.via {
+				t.Errorf("response Via = %q, want %q", v, tt.via)
+			}
+		})
+	}
+}
+
+func TestForwardUpgrade(t *testing.T) {
+	reqHeaders := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqHeaders <- r.Header
+		if !isUpgrade(r.Header) || r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "not an upgrade", http.StatusBadRequest)
+			return
+		}
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(c, brw)
+	}))
+	defer backend.Close()
+
+	var d net.Dialer
+	srv := httptest.NewServer(Handler(d.DialContext, Config{Forward: Forward{Via: true}}))
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET %s/ws HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: Upgrade, X-Hop\r\nUpgrade: websocket\r\nX-Hop: 1\r\n"+
+		"Proxy-Authorization: Basic dXNlcjpwYXNz\r\nX-Forwarded-For: 198.51.100.1\r\n\r\n",
+		backend.URL, backend.Listener.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("upgrade = %s, Upgrade %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+	if v := resp.Header.Get("Via"); v != "1.1 wghttp" {
+		t.Errorf("response Via = %q", v)
+	}
+
+	h := <-reqHeaders
+	for _, name := range []string{"X-Hop", "Proxy-Authorization", "X-Forwarded-For"} {
+		if v := h.Get(name); v != "" {
+			t.Errorf("request %s = %q, want it removed", name, v)
+		}
+	}
+	if v := h.Get("Via"); v != "1.1 wghttp" {
+		t.Errorf("request Via = %q", v)
+	}
+
+	// The upgraded connection is relayed both ways.
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		io.WriteString(c, msg)
+		got, err := br.ReadString('\n')
+		if err != nil || got != msg {
+			t.Fatalf("got %q, %v, want %q", got, err, msg)
+		}
+	}
+}
@@ -8,30 +8,118 @@ package httpproxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"time"
+
+	"github.com/zhsj/wghttp/internal/limit"
+	"github.com/zhsj/wghttp/internal/relay"
 )
 
+// Config configures Handler.
+type Config struct {
+	// Relay bounds CONNECT tunnels.
+	Relay relay.Config
+	// ConnectUDP enables RFC 9298 CONNECT-UDP over HTTP/1.1 upgrade.
+	ConnectUDP bool
+	// Forward configures proxying of requests other than CONNECT.
+	Forward Forward
+	// Authenticate optionally requires clients to authenticate with
+	// Proxy-Authorization, and reports whether the credentials are valid.
+	Authenticate func(user, password string) bool
+	// Policy optionally limits and shapes requests, a session is started
+	// for each request before dialing.
+	Policy *limit.Policy
+}
+
+// defaultIdleConnTimeout is IdleConnTimeout of Forward if it's zero, the
+// same as http.DefaultTransport.
+const defaultIdleConnTimeout = 90 * time.Second
+
+// Forward configures proxying of requests other than CONNECT. Like
+// http.Transport, zero MaxIdleConns means no limit and zero
+// MaxIdleConnsPerHost means 2. Unlike it, zero IdleConnTimeout means
+// defaultIdleConnTimeout, not keeping idle connections forever.
+type Forward struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	// Via adds the Via header to requests and responses.
+	Via bool
+	// ForwardedFor adds the client IP to the X-Forwarded-For header of
+	// requests, which is removed otherwise.
+	ForwardedFor bool
+}
+
 // Handler returns an HTTP proxy http.Handler using the
 // provided backend dialer.
-func Handler(dialer func(ctx context.Context, netw, addr string) (net.Conn, error)) http.Handler {
+func Handler(dialer func(ctx context.Context, netw, addr string) (net.Conn, error), cfg Config) http.Handler {
+	fwd := cfg.Forward
+	if fwd.IdleConnTimeout <= 0 {
+		fwd.IdleConnTimeout = defaultIdleConnTimeout
+	}
 	rp := &httputil.ReverseProxy{
-		Director: func(r *http.Request) {}, // no change
+		// ReverseProxy removes hop-by-hop headers, including
+		// Proxy-Authorization and Proxy-Connection.
+		Director: fwd.director,
 		Transport: &http.Transport{
-			DialContext: dialer,
+			DialContext:           dialer,
+			MaxIdleConns:          fwd.MaxIdleConns,
+			MaxIdleConnsPerHost:   fwd.MaxIdleConnsPerHost,
+			IdleConnTimeout:       fwd.IdleConnTimeout,
+			ResponseHeaderTimeout: fwd.ResponseHeaderTimeout,
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			fwd.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+			downloadBody(resp)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, err.Error(), dialErrorStatus(err, http.StatusBadGateway))
 		},
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Authenticate != nil {
+			user, password, ok := proxyAuth(r)
+			if !ok || !cfg.Authenticate(user, password) {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="wghttp"`)
+				http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+				return
+			}
+			r = r.WithContext(limit.WithUser(r.Context(), user))
+		}
+		sess, err := cfg.Policy.Start(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), dialErrorStatus(err, http.StatusServiceUnavailable))
+			return
+		}
+		defer sess.End()
+
+		if cfg.ConnectUDP && isConnectUDP(r) {
+			serveConnectUDP(w, r, dialer, cfg.Relay, sess)
+			return
+		}
+		if r.Method != "CONNECT" && r.ProtoMajor == 2 && r.URL.Host == "" {
+			// HTTP/2 requests have the target in :authority.
+			r.URL.Scheme, r.URL.Host = "http", r.Host
+			r.RequestURI = r.URL.String()
+		}
 		if r.Method != "CONNECT" {
 			backURL := r.RequestURI
 			if strings.HasPrefix(backURL, "/") || backURL == "*" {
 				http.Error(w, "bogus RequestURI; must be absolute URL or CONNECT", 400)
 				return
 			}
-			rp.ServeHTTP(w, r)
+			if isUpgrade(r.Header) {
+				serveUpgrade(w, r, dialer, cfg, sess)
+				return
+			}
+			rp.ServeHTTP(w, withSession(r, sess))
 			return
 		}
 
@@ -41,11 +129,20 @@ func Handler(dialer func(ctx context.Context, netw, addr string) (net.Conn, erro
 		c, err := dialer(r.Context(), "tcp", dst)
 		if err != nil {
 			w.Header().Set("Connect-Error", err.Error())
-			http.Error(w, err.Error(), 500)
+			http.Error(w, err.Error(), dialErrorStatus(err, 500))
 			return
 		}
 		defer c.Close()
 
+		if r.ProtoMajor == 2 {
+			// HTTP/2 streams can't be hijacked, the tunnel is
+			// carried by the request and response bodies.
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			cfg.Relay.PipeMetered(newStreamConn(w, r), nil, c, sess)
+			return
+		}
+
 		cc, ccbuf, err := w.(http.Hijacker).Hijack()
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -65,15 +162,24 @@ func Handler(dialer func(ctx context.Context, netw, addr string) (net.Conn, erro
 			clientSrc = cc
 		}
 
-		errc := make(chan error, 1)
-		go func() {
-			_, err := io.Copy(cc, c)
-			errc <- err
-		}()
-		go func() {
-			_, err := io.Copy(c, clientSrc)
-			errc <- err
-		}()
-		<-errc
+		cfg.Relay.PipeMetered(cc, clientSrc, c, sess)
 	})
 }
+
+// proxyAuth returns the username and password of Basic authentication in
+// Proxy-Authorization of r.
+func proxyAuth(r *http.Request) (user, password string, ok bool) {
+	auth := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	return auth.BasicAuth()
+}
+
+// dialErrorStatus returns the status code for a dial error.
+func dialErrorStatus(err error, code int) int {
+	switch {
+	case errors.Is(err, limit.ErrClientLimit), errors.Is(err, limit.ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, limit.ErrGlobalLimit):
+		return http.StatusServiceUnavailable
+	}
+	return code
+}
@@ -0,0 +1,144 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/zhsj/wghttp/internal/limit"
+)
+
+// echoServer echoes TCP connections until the test ends.
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// udpEchoServer echoes UDP packets until the test ends.
+func udpEchoServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestConnectH2C(t *testing.T) {
+	target := echoServer(t)
+	var d net.Dialer
+	srv := httptest.NewServer(h2c.NewHandler(Handler(d.DialContext, Config{}), &http2.Server{}))
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := (&http2.Transport{}).NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("CONNECT", "http://"+target, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("CONNECT = %s %s, want 200 over HTTP/2", resp.Proto, resp.Status)
+	}
+
+	// The tunnel is carried by the request and response bodies.
+	r := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("ping %d\n", i)
+		if _, err := io.WriteString(pw, msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.ReadString('\n')
+		if err != nil || got != msg {
+			t.Fatalf("got %q, %v, want %q", got, err, msg)
+		}
+	}
+	pw.Close()
+}
+
+func TestConnectUDP(t *testing.T) {
+	target := udpEchoServer(t)
+	var d net.Dialer
+	// Sessions are read through the policy, which must keep datagrams whole
+	// too.
+	policy := &limit.Policy{Shaper: limit.NewShaper(limit.ShaperConfig{}), Accounting: &limit.Accounting{}}
+	srv := httptest.NewServer(Handler(d.DialContext, Config{ConnectUDP: true, Policy: policy}))
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	host, port, _ := net.SplitHostPort(target)
+	fmt.Fprintf(c, "GET %s%s/%s/ HTTP/1.1\r\nHost: proxy\r\n"+
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n",
+		connectUDPPrefix, host, port)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("CONNECT-UDP = %s, want 101", resp.Status)
+	}
+
+	// Datagrams larger than the buffer of io.Copy are relayed whole.
+	cc := &capsuleConn{Conn: c, r: br}
+	buf := make([]byte, maxDatagramSize)
+	for _, msg := range []string{"small", strings.Repeat("x", 40000), "small again"} {
+		if _, err := cc.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := cc.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("echo of %d bytes: got %d bytes, %v", len(msg), n, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package httpproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/zhsj/wghttp/internal/relay"
+)
+
+// streamConn is a tunnel over an HTTP/2 CONNECT stream.
+type streamConn struct {
+	w     http.ResponseWriter
+	body  io.ReadCloser
+	local net.Addr
+	peer  net.Addr
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	c := &streamConn{w: w, body: r.Body, local: streamAddr("local"), peer: streamAddr(r.RemoteAddr)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+	return c
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil {
+		c.w.(http.Flusher).Flush()
+	}
+	return n, err
+}
+
+// Close stops reading the request body. The stream ends when the handler
+// returns.
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+// CloseWrite is unsupported, as the response can't end before the handler
+// returns.
+func (c *streamConn) CloseWrite() error {
+	return relay.ErrUnsupported
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.peer }
+func (c *streamConn) SetDeadline(t time.Time) error      { return relay.ErrUnsupported }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return relay.ErrUnsupported }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return relay.ErrUnsupported }
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
@@ -14,6 +14,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/zhsj/wghttp/internal/relay"
 )
 
 // SplitSOCKSAndHTTP accepts connections on ln and passes connections
@@ -31,24 +33,51 @@ func SplitSOCKSAndHTTP(ln net.Listener) (socksListener, httpListener net.Listene
 		closed: make(chan struct{}),
 	}
 
-	go splitSOCKSAndHTTPListener(ln, sl, hl)
+	go splitSOCKSAndHTTPListener(ln, sl, hl, nil)
 
 	return sl, hl
 }
 
-func splitSOCKSAndHTTPListener(ln net.Listener, sl, hl *listener) {
+// SplitSOCKSHTTPAndTLS is like SplitSOCKSAndHTTP, but also splits TLS
+// connections, which start with a handshake record, to tlsListener.
+func SplitSOCKSHTTPAndTLS(ln net.Listener) (socksListener, httpListener, tlsListener net.Listener) {
+	sl := &listener{
+		addr:   ln.Addr(),
+		c:      make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	hl := &listener{
+		addr:   ln.Addr(),
+		c:      make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	tl := &listener{
+		addr:   ln.Addr(),
+		c:      make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	go splitSOCKSAndHTTPListener(ln, sl, hl, tl)
+
+	return sl, hl, tl
+}
+
+func splitSOCKSAndHTTPListener(ln net.Listener, sl, hl, tl *listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			sl.Close()
 			hl.Close()
+			if tl != nil {
+				tl.Close()
+			}
 			return
 		}
-		go routeConn(conn, sl, hl)
+		go routeConn(conn, sl, hl, tl)
 	}
 }
 
-func routeConn(c net.Conn, socksListener, httpListener *listener) {
+func routeConn(c net.Conn, socksListener, httpListener, tlsListener *listener) {
 	if err := c.SetReadDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		c.Close()
 		return
@@ -71,9 +100,12 @@ func routeConn(c net.Conn, socksListener, httpListener *listener) {
 	}
 
 	// First byte of a SOCKS5 session is a version byte set to 5.
+	// First byte of a TLS session is a handshake record type set to 22.
 	var ln *listener
 	if b[0] == 5 {
 		ln = socksListener
+	} else if b[0] == 22 && tlsListener != nil {
+		ln = tlsListener
 	} else {
 		ln = httpListener
 	}
@@ -143,3 +175,5 @@ func (c *connWithOneByte) Read(bs []byte) (int, error) {
 	bs[0] = c.b
 	return 1, nil
 }
+
+func (c *connWithOneByte) CloseWrite() error { return relay.CloseWrite(c.Conn) }
@@ -22,12 +22,19 @@ import (
 	"net"
 	"strconv"
 	"time"
+
+	"github.com/zhsj/wghttp/internal/limit"
+	"github.com/zhsj/wghttp/internal/relay"
 )
 
 const (
 	noAuthRequired   byte = 0
+	passwordAuth     byte = 2
 	noAcceptableAuth byte = 255
 
+	// passwordAuthVersion is the auth version byte described in RFC 1929.
+	passwordAuthVersion = 1
+
 	// socks5Version is the byte that represents the SOCKS version
 	// in requests.
 	socks5Version byte = 5
@@ -82,6 +89,21 @@ type Server struct {
 	// Dialer optionally specifies the dialer to use for outgoing connections.
 	// If nil, the net package's standard dialer is used.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Relay bounds the lifetime of relayed connections.
+	Relay relay.Config
+
+	// ConnContext optionally specifies a function that modifies
+	// the context used for dialing on behalf of a new connection c.
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
+	// Authenticate optionally requires clients to authenticate with
+	// username and password, and reports whether they're valid.
+	Authenticate func(user, password string) bool
+
+	// Policy optionally limits sessions, which are started before
+	// dialing.
+	Policy *limit.Policy
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -111,7 +133,11 @@ func (s *Server) Serve(l net.Listener) error {
 		}
 		go func() {
 			defer c.Close()
-			conn := &Conn{clientConn: c, srv: s}
+			ctx := context.Background()
+			if s.ConnContext != nil {
+				ctx = s.ConnContext(ctx, c)
+			}
+			conn := &Conn{ctx: ctx, clientConn: c, srv: s}
 			err := conn.Run()
 			if err != nil {
 				s.logf("client connection failed: %v", err)
@@ -126,6 +152,7 @@ type Conn struct {
 	// The struct is filled by each of the internal
 	// methods in turn as the transaction progresses.
 
+	ctx        context.Context
 	srv        *Server
 	clientConn net.Conn
 	request    *request
@@ -133,12 +160,34 @@ type Conn struct {
 
 // Run starts the new connection.
 func (c *Conn) Run() error {
-	err := parseClientGreeting(c.clientConn)
+	needAuth := c.srv.Authenticate != nil
+	authMethod := noAuthRequired
+	if needAuth {
+		authMethod = passwordAuth
+	}
+
+	err := parseClientGreeting(c.clientConn, authMethod)
 	if err != nil {
 		c.clientConn.Write([]byte{socks5Version, noAcceptableAuth})
 		return err
 	}
-	c.clientConn.Write([]byte{socks5Version, noAuthRequired})
+	c.clientConn.Write([]byte{socks5Version, authMethod})
+	if !needAuth {
+		return c.handleRequest()
+	}
+
+	user, pwd, err := parseClientAuth(c.clientConn)
+	if err != nil {
+		c.clientConn.Write([]byte{passwordAuthVersion, 1}) // auth error
+		return err
+	}
+	if !c.srv.Authenticate(user, pwd) {
+		c.clientConn.Write([]byte{passwordAuthVersion, 1}) // auth error
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	c.clientConn.Write([]byte{passwordAuthVersion, 0}) // auth success
+	c.ctx = limit.WithUser(c.ctx, user)
+
 	return c.handleRequest()
 }
 
@@ -158,7 +207,16 @@ func (c *Conn) handleRequest() error {
 	}
 	c.request = req
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	sess, err := c.srv.Policy.Start(c.ctx)
+	if err != nil {
+		res := &response{reply: connectionNotAllowed}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer sess.End()
+
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
 	defer cancel()
 	srv, err := c.srv.dial(
 		ctx,
@@ -201,28 +259,12 @@ func (c *Conn) handleRequest() error {
 	}
 	c.clientConn.Write(buf)
 
-	errc := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(c.clientConn, srv)
-		if err != nil {
-			err = fmt.Errorf("from backend to client: %w", err)
-		}
-		errc <- err
-	}()
-	go func() {
-		_, err := io.Copy(srv, c.clientConn)
-		if err != nil {
-			err = fmt.Errorf("from client to backend: %w", err)
-		}
-		errc <- err
-	}()
-	return <-errc
+	return c.srv.Relay.PipeMetered(c.clientConn, nil, srv, sess)
 }
 
-// parseClientGreeting parses a request initiation packet
-// and returns a slice that contains the acceptable auth methods
-// for the client.
-func parseClientGreeting(r io.Reader) error {
+// parseClientGreeting parses a request initiation packet, and
+// returns an error if authMethod isn't acceptable for the client.
+func parseClientGreeting(r io.Reader, authMethod byte) error {
 	var hdr [2]byte
 	_, err := io.ReadFull(r, hdr[:])
 	if err != nil {
@@ -238,13 +280,37 @@ func parseClientGreeting(r io.Reader) error {
 		return fmt.Errorf("could not read methods")
 	}
 	for _, m := range methods {
-		if m == noAuthRequired {
+		if m == authMethod {
 			return nil
 		}
 	}
 	return fmt.Errorf("no acceptable auth methods")
 }
 
+// parseClientAuth parses the username/password request of RFC 1929.
+func parseClientAuth(r io.Reader) (usr, pwd string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", fmt.Errorf("could not read auth packet header")
+	}
+	if hdr[0] != passwordAuthVersion {
+		return "", "", fmt.Errorf("bad SOCKS auth version")
+	}
+	usrBytes := make([]byte, int(hdr[1]))
+	if _, err := io.ReadFull(r, usrBytes); err != nil {
+		return "", "", fmt.Errorf("could not read auth packet username")
+	}
+	var hdrPwd [1]byte
+	if _, err := io.ReadFull(r, hdrPwd[:]); err != nil {
+		return "", "", fmt.Errorf("could not read auth packet password length")
+	}
+	pwdBytes := make([]byte, int(hdrPwd[0]))
+	if _, err := io.ReadFull(r, pwdBytes); err != nil {
+		return "", "", fmt.Errorf("could not read auth packet password")
+	}
+	return string(usrBytes), string(pwdBytes), nil
+}
+
 // request represents data contained within a SOCKS5
 // connection request packet.
 type request struct {
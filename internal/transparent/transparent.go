@@ -0,0 +1,236 @@
+// Package transparent implements transparent proxying of connections
+// redirected by iptables or nftables, with REDIRECT or TPROXY.
+package transparent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Mode is how connections are redirected to the listener.
+type Mode string
+
+const (
+	// Redirect is for the REDIRECT target, which rewrites the destination.
+	// The original destination is recovered from conntrack.
+	Redirect Mode = "redirect"
+	// TProxy is for the TPROXY target, which keeps the destination. It
+	// requires CAP_NET_ADMIN.
+	TProxy Mode = "tproxy"
+)
+
+// ErrUnsupported is returned on platforms other than Linux.
+var ErrUnsupported = errors.New("transparent: only supported on Linux")
+
+// udpTimeout closes UDP sessions without packets for this time, the same as
+// the conntrack default.
+const udpTimeout = 2 * time.Minute
+
+// udpBufSize is the largest UDP payload.
+const udpBufSize = 64 * 1024
+
+// UDPRelay relays UDP packets redirected by TPROXY to their original
+// destinations.
+type UDPRelay struct {
+	// Dial dials the original destination.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Timeout closes idle sessions, default to 2 minutes if zero.
+	Timeout time.Duration
+	// Logf logs errors of sessions.
+	Logf func(format string, args ...any)
+	// dialReply is replaced in tests, which can't send from non-local
+	// addresses.
+	dialReply func(src, dst netip.AddrPort) (net.Conn, error)
+
+	mu       sync.Mutex
+	pc       *net.UDPConn
+	sessions map[udpKey]*udpSession
+	closed   bool
+}
+
+type udpKey struct {
+	src, dst netip.AddrPort
+}
+
+type udpSession struct {
+	upstream net.Conn
+	// reply sends packets to the client from the original destination.
+	reply net.Conn
+	last  time.Time
+}
+
+// Serve relays packets received on pc, which is from ListenUDP, until pc
+// fails or Close is called.
+func (r *UDPRelay) Serve(pc *net.UDPConn) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		pc.Close()
+		return net.ErrClosed
+	}
+	r.pc = pc
+	r.sessions = map[udpKey]*udpSession{}
+	r.mu.Unlock()
+
+	buf := make([]byte, udpBufSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := pc.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		dst, err := origDstAddr(oob[:oobn])
+		if err != nil {
+			r.logf("UDP from %s: %v", src, err)
+			continue
+		}
+		key := udpKey{src: unmap(src), dst: unmap(dst)}
+		s, err := r.session(key)
+		if err != nil {
+			r.logf("UDP from %s to %s: %v", key.src, key.dst, err)
+			continue
+		}
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			r.logf("UDP from %s to %s: %v", key.src, key.dst, err)
+		}
+	}
+}
+
+// session returns the session of key, creating it if needed.
+func (r *UDPRelay) session(key udpKey) (*udpSession, error) {
+	r.mu.Lock()
+	if s, ok := r.sessions[key]; ok {
+		s.last = time.Now()
+		r.mu.Unlock()
+		return s, nil
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+	upstream, err := r.Dial(ctx, "udp", key.dst.String())
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	dial := r.dialReply
+	if dial == nil {
+		dial = dialReply
+	}
+	reply, err := dial(key.dst, key.src)
+	if err != nil {
+		upstream.Close()
+		return nil, fmt.Errorf("create reply socket: %w", err)
+	}
+	s := &udpSession{upstream: upstream, reply: reply, last: time.Now()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		upstream.Close()
+		reply.Close()
+		return nil, net.ErrClosed
+	}
+	r.sessions[key] = s
+	go r.serveReply(key, s)
+	return s, nil
+}
+
+// serveReply sends packets from the upstream back to the client, and closes
+// the session when it's idle.
+func (r *UDPRelay) serveReply(key udpKey, s *udpSession) {
+	defer func() {
+		r.mu.Lock()
+		if r.sessions[key] == s {
+			delete(r.sessions, key)
+		}
+		r.mu.Unlock()
+		s.upstream.Close()
+		s.reply.Close()
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		s.upstream.SetReadDeadline(time.Now().Add(r.timeout()))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				r.mu.Lock()
+				last := s.last
+				r.mu.Unlock()
+				if time.Since(last) < r.timeout() {
+					continue
+				}
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				r.logf("UDP from %s to %s: %v", key.dst, key.src, err)
+			}
+			return
+		}
+		r.mu.Lock()
+		s.last = time.Now()
+		r.mu.Unlock()
+		if _, err := s.reply.Write(buf[:n]); err != nil {
+			r.logf("UDP from %s to %s: %v", key.dst, key.src, err)
+		}
+	}
+}
+
+// Close stops Serve and closes all sessions.
+func (r *UDPRelay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, s := range r.sessions {
+		s.upstream.Close()
+		s.reply.Close()
+	}
+	if r.pc != nil {
+		return r.pc.Close()
+	}
+	return nil
+}
+
+func (r *UDPRelay) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return udpTimeout
+}
+
+func (r *UDPRelay) logf(format string, args ...any) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
+	}
+}
+
+func unmap(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// netConn is implemented by connections wrapping another one.
+type netConn interface {
+	NetConn() net.Conn
+}
+
+// unwrap returns the innermost connection of c.
+func unwrap(c net.Conn) net.Conn {
+	for {
+		w, ok := c.(netConn)
+		if !ok {
+			return c
+		}
+		c = w.NetConn()
+	}
+}
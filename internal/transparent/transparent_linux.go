@@ -0,0 +1,181 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Listen listens on addr for TCP connections redirected in mode.
+func Listen(addr string, mode Mode) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if mode == TProxy {
+		lc.Control = control(false)
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenUDP listens on addr for UDP packets redirected by TPROXY.
+func ListenUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: control(true)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// OriginalDst returns the address c was destined to before it's redirected
+// in mode.
+func OriginalDst(c net.Conn, mode Mode) (string, error) {
+	if mode == TProxy {
+		// TPROXY keeps the destination as the local address.
+		return c.LocalAddr().String(), nil
+	}
+
+	tc, ok := unwrap(c).(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("not a TCP connection: %T", c)
+	}
+	local, ok := tc.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("unknown local address: %s", tc.LocalAddr())
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var dst netip.AddrPort
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// struct sockaddr_in fits in struct ipv6_mreq.
+			var mreq *unix.IPv6Mreq
+			mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if serr == nil {
+				dst = sockaddrToAddrPort(mreq.Multiaddr[:])
+			}
+			return
+		}
+		// IP6T_SO_ORIGINAL_DST has the same value, and struct sockaddr_in6
+		// fits in struct ip6_mtuinfo.
+		var info *unix.IPv6MTUInfo
+		info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if serr == nil {
+			b := (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))
+			dst = sockaddrToAddrPort(b[:])
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if serr != nil {
+		return "", fmt.Errorf("get original destination: %w", serr)
+	}
+	return unmap(dst).String(), nil
+}
+
+// control sets socket options for TPROXY, also receiving the original
+// destination of UDP packets if udp is true.
+func control(udp bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			opts := [][2]int{{unix.SOL_IP, unix.IP_TRANSPARENT}}
+			if udp {
+				opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+			}
+			if network == "tcp6" || network == "udp6" {
+				opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+				if udp {
+					opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+				}
+			}
+			for _, opt := range opts {
+				if err := unix.SetsockoptInt(int(fd), opt[0], opt[1], 1); err != nil {
+					serr = fmt.Errorf("set transparent socket: %w", err)
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// origDstAddr parses the original destination from control messages of
+// IP_RECVORIGDSTADDR or IPV6_RECVORIGDSTADDR.
+func origDstAddr(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, m := range msgs {
+		if (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR) ||
+			(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR) {
+			if dst := sockaddrToAddrPort(m.Data); dst.IsValid() {
+				return dst, nil
+			}
+		}
+	}
+	return netip.AddrPort{}, errors.New("no original destination")
+}
+
+// dialReply returns a UDP socket from src to dst, where src is a non-local
+// address.
+func dialReply(src, dst netip.AddrPort) (net.Conn, error) {
+	d := net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(src),
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+					serr = err
+					return
+				}
+				level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+				if network == "udp6" {
+					level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+				}
+				serr = unix.SetsockoptInt(int(fd), level, opt, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return d.Dial("udp", dst.String())
+}
+
+// sockaddrToAddrPort parses struct sockaddr_in or struct sockaddr_in6.
+func sockaddrToAddrPort(b []byte) netip.AddrPort {
+	if len(b) < 8 {
+		return netip.AddrPort{}
+	}
+	// sa_family is in host byte order.
+	var family uint16
+	copy((*[2]byte)(unsafe.Pointer(&family))[:], b)
+	port := binary.BigEndian.Uint16(b[2:])
+	var ip []byte
+	switch {
+	case family == unix.AF_INET:
+		ip = b[4:8]
+	case family == unix.AF_INET6 && len(b) >= unix.SizeofSockaddrInet6:
+		ip = b[8:24]
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port)
+}
@@ -0,0 +1,207 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockaddr returns ap as struct sockaddr_in or struct sockaddr_in6.
+func sockaddr(ap netip.AddrPort) []byte {
+	if ap.Addr().Is4() {
+		sa := unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: ap.Addr().As4()}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], ap.Port())
+		return append([]byte(nil), (*[unix.SizeofSockaddrInet4]byte)(unsafe.Pointer(&sa))[:]...)
+	}
+	sa := unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: ap.Addr().As16()}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], ap.Port())
+	return append([]byte(nil), (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(&sa))[:]...)
+}
+
+// cmsg returns a control message with data.
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = int32(level), int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
+
+func TestSockaddrToAddrPort(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:443")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:8443")
+	unknown := sockaddr(v4)
+	unknown[0], unknown[1] = 0xff, 0xff
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want netip.AddrPort
+	}{
+		{"ipv4", sockaddr(v4), v4},
+		{"ipv6", sockaddr(v6), v6},
+		{"short", sockaddr(v4)[:4], netip.AddrPort{}},
+		{"short ipv6", sockaddr(v6)[:unix.SizeofSockaddrInet4], netip.AddrPort{}},
+		{"unknown family", unknown, netip.AddrPort{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sockaddrToAddrPort(tt.b)
+			if got.IsValid() != tt.want.IsValid() || (got.IsValid() && got != tt.want) {
+				t.Errorf("sockaddrToAddrPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrigDstAddr(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:53")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	ttl := cmsg(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0})
+
+	for _, tt := range []struct {
+		name    string
+		oob     []byte
+		want    netip.AddrPort
+		wantErr bool
+	}{
+		{"ipv4", cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr(v4)), v4, false},
+		{"ipv6", cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddr(v6)), v6, false},
+		{"after another message", append(ttl, cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr(v4))...), v4, false},
+		{"other messages only", ttl, netip.AddrPort{}, true},
+		{"bad address", cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, []byte{1, 2}), netip.AddrPort{}, true},
+		{"truncated", cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sockaddr(v4))[:8], netip.AddrPort{}, true},
+		{"empty", nil, netip.AddrPort{}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := origDstAddr(tt.oob)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("origDstAddr() = %v, %v, want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUDPRelay(t *testing.T) {
+	// The original destination is received without TPROXY too, which is
+	// the local address then.
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := pc.LocalAddr().String()
+
+	// Upstreams and reply sockets are pipes, whose other ends are sent to
+	// the test.
+	type dialed struct {
+		address string
+		peer    net.Conn
+	}
+	upstreams, replies := make(chan dialed, 2), make(chan dialed, 2)
+	r := &UDPRelay{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, peer := net.Pipe()
+			upstreams <- dialed{address, peer}
+			return c, nil
+		},
+		Timeout: 200 * time.Millisecond,
+		Logf:    t.Logf,
+		dialReply: func(src, dst netip.AddrPort) (net.Conn, error) {
+			c, peer := net.Pipe()
+			replies <- dialed{src.String() + " " + dst.String(), peer}
+			return c, nil
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- r.Serve(pc.(*net.UDPConn)) }()
+
+	client, err := net.Dial("udp4", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func(msg string) {
+		t.Helper()
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(c net.Conn, want string) {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, udpBufSize)
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("got %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	next := func(ch <-chan dialed, want string) net.Conn {
+		t.Helper()
+		select {
+		case d := <-ch:
+			if d.address != want {
+				t.Errorf("dialed %s, want %s", d.address, want)
+			}
+			return d.peer
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing dialed")
+			return nil
+		}
+	}
+
+	// The first packet starts a session, and later ones use it.
+	send("one")
+	upstream := next(upstreams, dst)
+	reply := next(replies, dst+" "+client.LocalAddr().String())
+	recv(upstream, "one")
+	send("two")
+	recv(upstream, "two")
+	if len(upstreams) != 0 {
+		t.Error("session is dialed again")
+	}
+	if _, err := upstream.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	recv(reply, "pong")
+
+	// An idle session is closed, and the next packet starts a new one.
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := upstream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("idle session is not closed")
+	}
+	send("three")
+	upstream = next(upstreams, dst)
+	next(replies, dst+" "+client.LocalAddr().String())
+	recv(upstream, "three")
+
+	// Close stops Serve and closes sessions.
+	r.Close()
+	if err := <-errc; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve() = %v, want %v", err, net.ErrClosed)
+	}
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := upstream.Read(make([]byte, 1)); err == nil {
+		t.Error("session is not closed by Close")
+	}
+}
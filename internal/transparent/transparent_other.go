@@ -0,0 +1,32 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Listen listens on addr for TCP connections redirected in mode.
+func Listen(addr string, mode Mode) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+// ListenUDP listens on addr for UDP packets redirected by TPROXY.
+func ListenUDP(addr string) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+// OriginalDst returns the address c was destined to before it's redirected
+// in mode.
+func OriginalDst(c net.Conn, mode Mode) (string, error) {
+	return "", ErrUnsupported
+}
+
+func origDstAddr(oob []byte) (netip.AddrPort, error) {
+	return netip.AddrPort{}, ErrUnsupported
+}
+
+func dialReply(src, dst netip.AddrPort) (net.Conn, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,218 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+var _ conn.Bind = &Bind{}
+
+// dialTimeout bounds a connection attempt to the peer, WireGuard retries
+// the handshake anyway.
+const dialTimeout = 10 * time.Second
+
+type packet struct {
+	buf []byte
+	ep  conn.Endpoint
+}
+
+// maxPending is the number of packets queued for an endpoint while dialing.
+const maxPending = 16
+
+// Bind is a conn.Bind which sends packets over PacketConns dialed on demand.
+type Bind struct {
+	Dial func(ctx context.Context, addr netip.AddrPort) (PacketConn, error)
+	// Logf optionally logs failed connections.
+	Logf func(format string, args ...any)
+
+	mu    sync.Mutex
+	conns map[netip.AddrPort]PacketConn
+	// pending has the queued packets of endpoints being dialed.
+	pending map[netip.AddrPort][][]byte
+	recv    chan packet
+	closed  chan struct{}
+}
+
+func (b *Bind) logf(format string, args ...any) {
+	if b.Logf != nil {
+		b.Logf(format, args...)
+	}
+}
+
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.conns = map[netip.AddrPort]PacketConn{}
+	b.pending = map[netip.AddrPort][][]byte{}
+	b.recv = make(chan packet, conn.IdealBatchSize)
+	b.closed = make(chan struct{})
+
+	recv, closed := b.recv, b.closed
+	fn := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case p := <-recv:
+			sizes[0] = copy(packets[0], p.buf)
+			eps[0] = p.ep
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{fn}, port, nil
+}
+
+func (b *Bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return nil
+	}
+	close(b.closed)
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns, b.pending, b.recv, b.closed = nil, nil, nil, nil
+	return nil
+}
+
+func (b *Bind) SetMark(mark uint32) error { return nil }
+
+func (b *Bind) BatchSize() int { return 1 }
+
+func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addr}, nil
+}
+
+// Send writes bufs to the connection to the endpoint. Without one, bufs are
+// queued and the endpoint is dialed in the background, so WireGuard isn't
+// blocked by a slow dial.
+func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	addr, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if b.closed == nil {
+		b.mu.Unlock()
+		return net.ErrClosed
+	}
+	c, ok := b.conns[addr]
+	if !ok {
+		b.queue(addr, ep, bufs)
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+
+	for _, buf := range bufs {
+		if err := c.WritePacket(buf); err != nil {
+			b.drop(addr, c)
+			return err
+		}
+	}
+	return nil
+}
+
+// queue keeps copies of bufs until addr is connected, and starts dialing it
+// if it's not dialing yet. Packets beyond maxPending are dropped, WireGuard
+// retransmits handshakes anyway. b.mu must be held.
+func (b *Bind) queue(addr netip.AddrPort, ep conn.Endpoint, bufs [][]byte) {
+	pending, dialing := b.pending[addr]
+	for _, buf := range bufs {
+		if len(pending) >= maxPending {
+			break
+		}
+		pending = append(pending, append([]byte(nil), buf...))
+	}
+	b.pending[addr] = pending
+	if !dialing {
+		go b.dial(addr, ep, b.recv, b.closed)
+	}
+}
+
+// dial connects to addr, sends the queued packets, then reads from the
+// connection until it fails.
+func (b *Bind) dial(addr netip.AddrPort, ep conn.Endpoint, recv chan<- packet, closed chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	c, err := b.Dial(ctx, addr)
+	cancel()
+	if err != nil {
+		b.mu.Lock()
+		if b.closed == closed {
+			delete(b.pending, addr)
+		}
+		b.mu.Unlock()
+		b.logf("Dial %s: %v", addr, err)
+		return
+	}
+
+	// Packets queued while sending are sent too, before the connection
+	// is used by Send, so they stay in order.
+	for {
+		b.mu.Lock()
+		if b.closed != closed {
+			b.mu.Unlock()
+			c.Close()
+			return
+		}
+		pending := b.pending[addr]
+		if len(pending) == 0 {
+			delete(b.pending, addr)
+			b.conns[addr] = c
+			b.mu.Unlock()
+			break
+		}
+		b.pending[addr] = nil
+		b.mu.Unlock()
+		for _, buf := range pending {
+			if err := c.WritePacket(buf); err != nil {
+				b.logf("Send to %s: %v", addr, err)
+				c.Close()
+				b.mu.Lock()
+				if b.closed == closed {
+					delete(b.pending, addr)
+				}
+				b.mu.Unlock()
+				return
+			}
+		}
+	}
+	b.read(addr, ep, c, recv, closed)
+}
+
+func (b *Bind) read(addr netip.AddrPort, ep conn.Endpoint, c PacketConn, recv chan<- packet, closed <-chan struct{}) {
+	defer b.drop(addr, c)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := c.ReadPacket(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case recv <- packet{buf: append([]byte(nil), buf[:n]...), ep: ep}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (b *Bind) drop(addr netip.AddrPort, c PacketConn) {
+	c.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns[addr] == c {
+		delete(b.conns, addr)
+	}
+}
@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TCPDialer returns a dialer for length framed packets over TCP.
+func TCPDialer() func(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	return func(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+		c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		return NewStreamConn(c), nil
+	}
+}
+
+// WebSocketDialer returns a dialer for packets over WebSocket. The
+// connection goes to the resolved address, while the Host header and TLS
+// server name use the host returned by host, if it's not empty.
+func WebSocketDialer(secure bool, path string, header http.Header, host func(netip.AddrPort) string) func(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+	return func(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+		hostname := addr.Addr().String()
+		if h := host(addr); h != "" {
+			hostname = h
+		}
+		u := &url.URL{Scheme: "ws", Host: net.JoinHostPort(hostname, strconv.Itoa(int(addr.Port()))), Path: path}
+		origin := "http://" + u.Host
+		if secure {
+			u.Scheme, origin = "wss", "https://"+u.Host
+		}
+		config, err := websocket.NewConfig(u.String(), origin)
+		if err != nil {
+			return nil, err
+		}
+		config.Header = header
+
+		c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		if secure {
+			tc := tls.Client(c, &tls.Config{ServerName: hostname})
+			if err := tc.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			c = tc
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = c.SetDeadline(deadline)
+		}
+		ws, err := websocket.NewClient(config, c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		_ = c.SetDeadline(time.Time{})
+		return NewWebSocketConn(ws), nil
+	}
+}
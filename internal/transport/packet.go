@@ -0,0 +1,91 @@
+// Package transport carries WireGuard packets over streams, for networks
+// that block UDP.
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// maxPacketSize is the largest packet a 2 bytes length header can carry.
+const maxPacketSize = 1<<16 - 1
+
+// PacketConn is a message oriented connection, one packet per message.
+type PacketConn interface {
+	ReadPacket(b []byte) (int, error)
+	WritePacket(b []byte) error
+	Close() error
+}
+
+// streamConn frames packets on a stream with a 2 bytes big endian length
+// header, the same as mullvad's udp-over-tcp.
+type streamConn struct {
+	conn net.Conn
+	mu   sync.Mutex // serializes WritePacket
+}
+
+func NewStreamConn(conn net.Conn) PacketConn {
+	return &streamConn{conn: conn}
+}
+
+func (c *streamConn) ReadPacket(b []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(b) {
+		return 0, fmt.Errorf("packet of %d bytes exceeds buffer", n)
+	}
+	return io.ReadFull(c.conn, b[:n])
+}
+
+func (c *streamConn) WritePacket(b []byte) error {
+	if len(b) > maxPacketSize {
+		return fmt.Errorf("packet of %d bytes is too large", len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *streamConn) Close() error { return c.conn.Close() }
+
+// wsConn sends one packet per binary WebSocket message, the same as
+// wstunnel's UDP mode.
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+func NewWebSocketConn(conn *websocket.Conn) PacketConn {
+	conn.PayloadType = websocket.BinaryFrame
+	return &wsConn{conn: conn}
+}
+
+func (c *wsConn) ReadPacket(b []byte) (int, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(c.conn, &msg); err != nil {
+		return 0, err
+	}
+	if len(msg) > len(b) {
+		return 0, errors.New("packet exceeds buffer")
+	}
+	return copy(b, msg), nil
+}
+
+func (c *wsConn) WritePacket(b []byte) error {
+	return websocket.Message.Send(c.conn, b)
+}
+
+func (c *wsConn) Close() error { return c.conn.Close() }
@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// udpIdleTimeout closes a relayed session when the WireGuard server sends
+// nothing for this time. With traffic, WireGuard rekeys every 2 minutes.
+const udpIdleTimeout = 5 * time.Minute
+
+// Relay turns packets from stream transports back into UDP toward a
+// WireGuard server.
+type Relay struct {
+	// Upstream is the WireGuard server address.
+	Upstream string
+	// Logf optionally logs relay sessions.
+	Logf func(format string, args ...any)
+}
+
+func (r *Relay) logf(format string, args ...any) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
+	}
+}
+
+// ServeStream relays length framed packets from connections accepted on ln.
+func (r *Relay) ServeStream(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go r.relay(c.RemoteAddr().String(), NewStreamConn(c))
+	}
+}
+
+// WebSocketHandler relays packets from WebSocket connections.
+func (r *Relay) WebSocketHandler() http.Handler {
+	// Not websocket.Handler, which rejects clients without an Origin header.
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		r.relay(ws.Request().RemoteAddr, NewWebSocketConn(ws))
+	}}
+}
+
+func (r *Relay) relay(client string, c PacketConn) {
+	defer c.Close()
+
+	upstream, err := net.Dial("udp", r.Upstream)
+	if err != nil {
+		r.logf("Relay %s: %v", client, err)
+		return
+	}
+	defer upstream.Close()
+	r.logf("Relay %s to %s", client, upstream.RemoteAddr())
+
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := c.ReadPacket(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if _, err := upstream.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			_ = upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, err := upstream.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if err := c.WritePacket(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	err = <-errc
+	r.logf("Relay %s closed: %v", client, err)
+}
@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestStreamConn(t *testing.T) {
+	a, b := net.Pipe()
+	ca, cb := NewStreamConn(a), NewStreamConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	for _, size := range []int{0, 1, 148, 1420, maxPacketSize} {
+		sent := bytes.Repeat([]byte{byte(size)}, size)
+		go func() {
+			if err := ca.WritePacket(sent); err != nil {
+				t.Error(err)
+			}
+		}()
+		buf := make([]byte, maxPacketSize)
+		n, err := cb.ReadPacket(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], sent) {
+			t.Errorf("got %d bytes, want %d bytes", n, size)
+		}
+	}
+}
+
+func TestBindRelay(t *testing.T) {
+	// A UDP echo server in place of the WireGuard server.
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udp.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &Relay{Upstream: udp.LocalAddr().String()}
+	go func() { _ = relay.ServeStream(ln) }()
+	defer ln.Close()
+
+	bind := &Bind{Dial: TCPDialer()}
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep, err := bind.ParseEndpoint(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := []byte("handshake")
+	if err := bind.Send([][]byte{sent}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	packets, sizes, eps := [][]byte{make([]byte, maxPacketSize)}, make([]int, 1), make([]conn.Endpoint, 1)
+	n, err := fns[0](packets, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(packets[0][:sizes[0]], sent) {
+		t.Errorf("got %q, want %q", packets[0][:sizes[0]], sent)
+	}
+	if eps[0].DstToString() != ln.Addr().String() {
+		t.Errorf("got endpoint %s, want %s", eps[0].DstToString(), ln.Addr())
+	}
+
+	if err := bind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fns[0](packets, sizes, eps); err != net.ErrClosed {
+		t.Errorf("got %v after close, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestBindQueue(t *testing.T) {
+	// Dials wait until the test answers them.
+	type dialResult struct {
+		c   PacketConn
+		err error
+	}
+	dials := make(chan chan dialResult)
+	bind := &Bind{
+		Dial: func(ctx context.Context, addr netip.AddrPort) (PacketConn, error) {
+			ch := make(chan dialResult)
+			dials <- ch
+			r := <-ch
+			return r.c, r.err
+		},
+	}
+	logs := make(chan string, 1)
+	bind.Logf = func(format string, args ...any) { logs <- fmt.Sprintf(format, args...) }
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	ep, err := bind.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(msgs ...string) {
+		t.Helper()
+		for _, msg := range msgs {
+			if err := bind.Send([][]byte{[]byte(msg)}, ep); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Send doesn't wait for a failed dial, which drops the queue.
+	send("lost")
+	(<-dials) <- dialResult{err: errors.New("unreachable")}
+	t.Log(<-logs)
+
+	// Packets sent while dialing are queued, and sent in order once
+	// connected.
+	send("one")
+	dial := <-dials
+	send("two")
+	var queued []string
+	for i := 0; i < maxPending+2; i++ {
+		msg := fmt.Sprint("queued ", i)
+		queued = append(queued, msg)
+		send(msg)
+	}
+	a, b := net.Pipe()
+	peer := NewStreamConn(b)
+	defer peer.Close()
+	dial <- dialResult{c: NewStreamConn(a)}
+
+	buf := make([]byte, maxPacketSize)
+	recv := func(want string) {
+		t.Helper()
+		n, err := peer.ReadPacket(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("got %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	recv("one")
+	recv("two")
+	for _, msg := range queued[:maxPending-2] {
+		recv(msg)
+	}
+	// net.Pipe is synchronous, so Send on the connection waits for recv.
+	errc := make(chan error, 1)
+	go func() { errc <- bind.Send([][]byte{[]byte("connected")}, ep) }()
+	recv("connected")
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dials:
+		t.Error("dialed again while connected")
+	default:
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+type genKeyCommand struct{}
+
+func (c *genKeyCommand) Execute(args []string) error {
+	key, err := randomKey()
+	if err != nil {
+		return err
+	}
+	// Clamp the key as wg(8) does.
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+type genPSKCommand struct{}
+
+func (c *genPSKCommand) Execute(args []string) error {
+	key, err := randomKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+type pubKeyCommand struct{}
+
+func (c *pubKeyCommand) Execute(args []string) error {
+	key, err := readPrivateKey(os.Stdin)
+	if err != nil {
+		return err
+	}
+	pub, err := publicKey(key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+// readPrivateKey reads the private key from stdin when it's piped, like
+// `wg genkey | wg pubkey`, even if a private key is set in the environment or
+// the credentials. Otherwise it uses the configured private key.
+func readPrivateKey(stdin *os.File) ([]byte, error) {
+	var key []byte
+	var err error
+	if fi, statErr := stdin.Stat(); opts.PrivateKey != "" && (statErr != nil || fi.Mode()&os.ModeCharDevice != 0) {
+		key, err = hex.DecodeString(string(opts.PrivateKey))
+	} else {
+		var line string
+		line, err = bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("read private key: %w", err)
+		}
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode private key: %w", err)
+	}
+	return key, nil
+}
+
+func randomKey() ([]byte, error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	return key, nil
+}
+
+func publicKey(private []byte) ([]byte, error) {
+	if len(private) != curve25519.ScalarSize {
+		return nil, errors.New("private key must be 32 bytes")
+	}
+	return curve25519.X25519(private, curve25519.Basepoint)
+}
+
+// loadKeys reads keys from --private-key-file and --preshared-key-file, or
+// systemd credentials, if they're not given in options. The resolved paths
+// are kept in options for reloading.
+func loadKeys() error {
+	var err error
+	opts.PrivateKeyFile, err = loadKey((*keyT)(&opts.PrivateKey), opts.PrivateKeyFile, "private-key")
+	if err != nil {
+		return err
+	}
+	opts.PresharedKeyFile, err = loadKey((*keyT)(&opts.PresharedKey), opts.PresharedKeyFile, "preshared-key")
+	return err
+}
+
+// loadKey loads a key for option --name, from the credential of the same
+// name by default.
+func loadKey(key *keyT, file, name string) (string, error) {
+	if *key != "" {
+		if file != "" {
+			return "", fmt.Errorf("--%s and --%s-file are both given", name, name)
+		}
+		return "", nil
+	}
+	if file == "" {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", nil
+		}
+		file = filepath.Join(dir, name)
+		if _, err := os.Stat(file); err != nil {
+			return "", nil
+		}
+	}
+	k, err := readKeyFile(file)
+	if err != nil {
+		return "", err
+	}
+	*key = k
+	return file, nil
+}
+
+func readKeyFile(file string) (keyT, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("read key: %w", err)
+	}
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 {
+		logger.Errorf("Key file %s is accessible by others (mode %s), consider chmod 600", file, perm)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("read key: %w", err)
+	}
+	var key keyT
+	if err := key.UnmarshalFlag(strings.TrimSpace(string(content))); err != nil {
+		return "", fmt.Errorf("decode key in %s: %w", file, err)
+	}
+	return key, nil
+}
+
+// reloadKeys re-reads key files on SIGHUP, and applies changed keys to the
+// device. The keys in use are kept here, the ones in opts and peer are only
+// for the initial config and aren't updated.
+func reloadKeys(dev *device.Device, peer *peer) {
+	privateKey, psk := opts.PrivateKey, peer.psk
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		conf := ""
+		if opts.PrivateKeyFile != "" {
+			key, err := readKeyFile(opts.PrivateKeyFile)
+			if err != nil {
+				logger.Errorf("Reload private key: %v", err)
+			} else if privateKeyT(key) != privateKey {
+				privateKey = privateKeyT(key)
+				conf += fmt.Sprintf("private_key=%s\n", key)
+			}
+		}
+		if opts.PresharedKeyFile != "" {
+			key, err := readKeyFile(opts.PresharedKeyFile)
+			if err != nil {
+				logger.Errorf("Reload preshared key: %v", err)
+			} else if presharedKeyT(key) != psk {
+				psk = presharedKeyT(key)
+				conf += fmt.Sprintf("public_key=%s\nupdate_only=true\npreshared_key=%s\n", peer.pubKey, key)
+			}
+		}
+		if conf == "" {
+			logger.Verbosef("Reload: keys are not changed")
+			continue
+		}
+		if err := dev.IpcSet(conf); err != nil {
+			logger.Errorf("Config device: %v", err)
+			continue
+		}
+		logger.Verbosef("Reload: keys are updated")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+)
+
+func TestReadPrivateKey(t *testing.T) {
+	// Key pairs of Alice and Bob in RFC 7748, section 6.1.
+	const (
+		alicePrivate = "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="
+		alicePublic  = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+		bobPrivate   = "XasIfmJKikt54X+Lg4AO5m87sSkmGLb9HC+LJ/+I4Os="
+		bobPublic    = "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08="
+	)
+	saved := opts
+	defer func() { opts = saved }()
+	if err := (*keyT)(&opts.PrivateKey).UnmarshalFlag(bobPrivate); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := func(stdin *os.File) string {
+		t.Helper()
+		key, err := readPrivateKey(stdin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := publicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(pub)
+	}
+
+	// A piped key takes priority over the configured one.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := w.WriteString(alicePrivate + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if got := pub(r); got != alicePublic {
+		t.Errorf("public key of piped key = %s, want %s", got, alicePublic)
+	}
+
+	// A character device, like a terminal, isn't read.
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if got := pub(null); got != bobPublic {
+		t.Errorf("public key of configured key = %s, want %s", got, bobPublic)
+	}
+}
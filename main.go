@@ -2,21 +2,33 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 
+	"github.com/zhsj/wghttp/internal/limit"
 	"github.com/zhsj/wghttp/internal/proxy"
+	"github.com/zhsj/wghttp/internal/systemd"
+	"github.com/zhsj/wghttp/internal/third_party/tailscale/httpproxy"
+	"github.com/zhsj/wghttp/internal/transparent"
 )
 
+// accountingInterval is how often traffic records are saved.
+const accountingInterval = time.Minute
+
 //go:embed README.md
 var readme string
 
@@ -29,6 +41,47 @@ func main() {
 	parser := flags.NewParser(&opts, flags.Default)
 	parser.LongDescription = fmt.Sprintf("wghttp %s\n\n", version())
 	parser.LongDescription += strings.Trim(strings.TrimPrefix(readme, "# wghttp"), "\n")
+	parser.SubcommandsOptional = true
+	_, _ = parser.AddCommand("relay", "Relay WireGuard over TCP or WebSocket to UDP",
+		"Run on the server side to accept --transport=tcp/ws/wss from wghttp,\n"+
+			"and forward the packets to a WireGuard server over UDP.", &relayCommand{})
+	_, _ = parser.AddCommand("genkey", "Generate a private key",
+		"Generate a private key in base64, the same as wg genkey.", &genKeyCommand{})
+	_, _ = parser.AddCommand("pubkey", "Print the public key",
+		"Print the public key of the private key read from stdin, the same as\n"+
+			"wg pubkey, or of --private-key if stdin is a terminal.", &pubKeyCommand{})
+	_, _ = parser.AddCommand("genpsk", "Generate a preshared key",
+		"Generate a preshared key in base64, the same as wg genpsk.", &genPSKCommand{})
+	_, _ = parser.AddCommand("check", "Check configuration and connectivity",
+		"Validate options, bring up the tunnel, then test DNS and TCP through it.\n"+
+			"Exit with non-zero code if any check fails.", &checkCommand{})
+	_, _ = parser.AddCommand("status", "Show status of a running instance",
+		"Query the admin server at --admin-listen, or /stats of the HTTP proxy\n"+
+			"at --listen, and print a summary.", &statusCommand{})
+	relaxRequired(parser)
+	parser.CommandHandler = func(cmd flags.Commander, args []string) error {
+		setupLogger()
+		if err := loadKeys(); err != nil {
+			return err
+		}
+		if err := loadHosts(); err != nil {
+			return fmt.Errorf("load hosts: %w", err)
+		}
+		if t := time.Duration(opts.HandshakeTimeout) * time.Second; t > 0 && t < minHandshakeTimeout {
+			return fmt.Errorf("--handshake-timeout %s is shorter than %s", t, minHandshakeTimeout)
+		}
+		if cmd != nil {
+			return cmd.Execute(args)
+		}
+		if opts.PrivateKey == "" {
+			return errors.New("the required flag `--private-key' or `--private-key-file' was not specified")
+		}
+		if opts.IdleConnTimeout <= 0 {
+			return errors.New("--idle-conn-timeout must be positive, idle connections would be kept forever")
+		}
+		return nil
+	}
+
 	if _, err := parser.Parse(); err != nil {
 		code := 1
 		fe := &flags.Error{}
@@ -37,31 +90,183 @@ func main() {
 		}
 		os.Exit(code)
 	}
-	if opts.Verbose {
-		logger = device.NewLogger(device.LogLevelVerbose, "")
-	} else {
-		logger = device.NewLogger(device.LogLevelError, "")
+	if parser.Active != nil {
+		return
 	}
 	logger.Verbosef("Options: %+v", opts)
 
-	dev, tnet, err := setupNet()
+	dev, tnet, peer, err := setupNet()
 	if err != nil {
 		logger.Errorf("Setup netstack: %v", err)
 		os.Exit(1)
 	}
 
+	go reloadKeys(dev, peer)
+
+	if opts.UAPISocket != "" {
+		if err := serveUAPI(dev); err != nil {
+			logger.Errorf("Setup UAPI: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	listener, err := proxyListener(tnet)
 	if err != nil {
 		logger.Errorf("Create net listener: %v", err)
 		os.Exit(1)
 	}
 
-	proxier := proxy.Proxy{
-		Dial: proxyDialer(tnet), DNS: opts.DNS, Stats: stats(dev),
+	proxier := &proxy.Proxy{
+		Dial: proxyDialer(tnet), DNS: resolverConfig(opts.DNS), Prefer: opts.Prefer,
+
+		IdleTimeout: time.Duration(opts.IdleTimeout) * time.Second,
+		MaxDuration: time.Duration(opts.MaxSessionDuration) * time.Second,
+
+		Users:             map[string]string{},
+		MaxConns:          opts.MaxConns,
+		MaxConnsPerClient: opts.MaxConnsPerClient,
+		Shaper:            newShaper(),
+		Upstreams:         map[string]*url.URL{},
+		ConnectUDP:        opts.ConnectUDP,
+		Forward: httpproxy.Forward{
+			MaxIdleConns:          opts.MaxIdleConns,
+			MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+			IdleConnTimeout:       time.Duration(opts.IdleConnTimeout) * time.Second,
+			ResponseHeaderTimeout: time.Duration(opts.ResponseHeaderTimeout) * time.Second,
+			Via:                   opts.Via,
+			ForwardedFor:          opts.ForwardedFor,
+		},
+	}
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			logger.Errorf("Load TLS certificate: %v", err)
+			os.Exit(1)
+		}
+		proxier.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	for _, u := range opts.ProxyUsers {
+		proxier.Users[u.name] = u.password
+	}
+	for _, u := range opts.Upstreams {
+		proxier.Upstreams[u.name] = u.url
+	}
+	for _, r := range opts.Routes {
+		proxier.Routes = append(proxier.Routes, proxy.Route{Pattern: r.pattern, Upstream: r.upstream})
+	}
+	if opts.AccountingFile != "" || opts.MonthlyQuota > 0 {
+		proxier.Accounting = &limit.Accounting{Path: opts.AccountingFile, Quota: int64(opts.MonthlyQuota)}
+		if err := proxier.Accounting.Load(); err != nil {
+			logger.Errorf("Load accounting: %v", err)
+			os.Exit(1)
+		}
+		go saveAccounting(proxier.Accounting)
+	}
+	if !opts.NoProxyStats {
+		proxier.Stats = stats(dev, peer, proxier)
+	}
+
+	if opts.AdminListen != "" {
+		if err := serveAdmin(dev, peer, proxier); err != nil {
+			logger.Errorf("Setup admin: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	errc := make(chan error, 3+len(opts.SniffListen))
+	var udpRelay *transparent.UDPRelay
+	if opts.TransparentListen != "" {
+		udpRelay, err = serveTransparent(tnet, proxier, errc)
+		if err != nil {
+			logger.Errorf("Setup transparent proxy: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := serveSniff(tnet, proxier, errc); err != nil {
+		logger.Errorf("Setup sniff listener: %v", err)
+		os.Exit(1)
+	}
+	go func() {
+		errc <- proxier.Serve(listener)
+	}()
+	go notifySystemd(dev, peer, proxier)
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		logger.Errorf("Serve proxy: %v", err)
+		os.Exit(1)
+	case s := <-sig:
+		logger.Verbosef("Received %s, shutting down", s)
+	}
+	notify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.GracePeriod)*time.Second)
+	go func() {
+		// Another signal skips draining.
+		<-sig
+		cancel()
+	}()
+	if udpRelay != nil {
+		udpRelay.Close()
+	}
+	if err := proxier.Shutdown(ctx); err != nil {
+		logger.Errorf("Shutdown proxy: %v", err)
+	}
+	cancel()
+	if proxier.Accounting != nil {
+		if err := proxier.Accounting.Save(); err != nil {
+			logger.Errorf("Save accounting: %v", err)
+		}
+	}
+	dev.Close()
+}
+
+// relaxRequired makes options of the proxy optional when a command which
+// doesn't bring up the tunnel is given.
+func relaxRequired(parser *flags.Parser) {
+	for _, arg := range os.Args[1:] {
+		if arg == "--" {
+			return
+		}
+		if cmd := parser.Find(arg); cmd != nil && cmd.Name != "check" {
+			for _, g := range parser.Groups() {
+				for _, o := range g.Options() {
+					o.Required = false
+				}
+			}
+			return
+		}
 	}
-	proxier.Serve(listener)
+}
 
-	os.Exit(1)
+func newShaper() *limit.Shaper {
+	bandwidth := func(rate sizeT) limit.Bandwidth {
+		return limit.Bandwidth{Rate: int64(rate), Burst: int64(opts.RateBurst)}
+	}
+	return limit.NewShaper(limit.ShaperConfig{
+		Upload:         bandwidth(opts.UploadRate),
+		Download:       bandwidth(opts.DownloadRate),
+		ClientUpload:   bandwidth(opts.ClientUploadRate),
+		ClientDownload: bandwidth(opts.ClientDownloadRate),
+	})
+}
+
+func saveAccounting(a *limit.Accounting) {
+	for range time.Tick(accountingInterval) {
+		if err := a.Save(); err != nil {
+			logger.Errorf("Save accounting: %v", err)
+		}
+	}
+}
+
+func setupLogger() {
+	if opts.Verbose {
+		logger = device.NewLogger(device.LogLevelVerbose, "")
+	} else {
+		logger = device.NewLogger(device.LogLevelError, "")
+	}
 }
 
 func proxyDialer(tnet *netstack.Net) (dialer func(ctx context.Context, network, address string) (net.Conn, error)) {
@@ -90,6 +295,17 @@ func proxyListener(tnet *netstack.Net) (net.Listener, error) {
 			return nil, fmt.Errorf("create listener on netstack: %w", err)
 		}
 	case "remote":
+		listeners, err := systemd.Listeners()
+		if err != nil {
+			return nil, fmt.Errorf("get listener from systemd: %w", err)
+		}
+		if len(listeners) > 0 {
+			for _, ln := range listeners[1:] {
+				ln.Close()
+			}
+			logger.Verbosef("Listening on %s from systemd", listeners[0].Addr())
+			return listeners[0], nil
+		}
 		tcpListener, err = net.ListenTCP("tcp", tcpAddr)
 		if err != nil {
 			return nil, fmt.Errorf("create listener on local net: %w", err)
@@ -99,24 +315,32 @@ func proxyListener(tnet *netstack.Net) (net.Listener, error) {
 	return tcpListener, nil
 }
 
-func setupNet() (*device.Device, *netstack.Net, error) {
+func setupNet() (*device.Device, *netstack.Net, *peer, error) {
 	clientIPs := []netip.Addr{}
 	for _, ip := range opts.ClientIPs {
 		clientIPs = append(clientIPs, netip.Addr(ip))
 	}
 	tun, tnet, err := netstack.CreateNetTUN(clientIPs, nil, opts.MTU)
 	if err != nil {
-		return nil, nil, fmt.Errorf("create netstack tun: %w", err)
+		return nil, nil, nil, fmt.Errorf("create netstack tun: %w", err)
 	}
-	dev := device.NewDevice(tun, newConnBind(opts.ClientID), logger)
+	bind, err := newConnBind(opts.ClientID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("create bind: %w", err)
+	}
+	dev := device.NewDevice(tun, bind, logger)
 
-	if err := ipcSet(dev); err != nil {
-		return nil, nil, fmt.Errorf("config device: %w", err)
+	peer, err := ipcSet(dev)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("config device: %w", err)
 	}
 
 	if err := dev.Up(); err != nil {
-		return nil, nil, fmt.Errorf("bring up device: %w", err)
+		return nil, nil, nil, fmt.Errorf("bring up device: %w", err)
+	}
+	if cb, ok := bind.(*connBind); ok {
+		go cb.rotate(dev)
 	}
 
-	return dev, tnet, nil
+	return dev, tnet, peer, nil
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/zhsj/wghttp/internal/transport"
+)
+
+type relayCommand struct {
+	Listen   string `long:"listen" env:"RELAY_LISTEN" required:"true" description:"Relay server address"`
+	Mode     string `long:"mode" env:"RELAY_MODE" choice:"tcp" choice:"ws" default:"tcp" description:"Transport accepted by relay"`
+	Upstream string `long:"upstream" env:"RELAY_UPSTREAM" required:"true" description:"WireGuard server address (format: host:port)"`
+	Path     string `long:"path" env:"RELAY_PATH" default:"/" description:"URL path for ws mode"`
+	TLSCert  string `long:"tls-cert" env:"RELAY_TLS_CERT" description:"TLS certificate file for ws mode (optional)"`
+	TLSKey   string `long:"tls-key" env:"RELAY_TLS_KEY" description:"TLS key file for ws mode (optional)"`
+}
+
+func (c *relayCommand) Execute(args []string) error {
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return fmt.Errorf("create relay listener: %w", err)
+	}
+	logger.Verbosef("Relay listening on %s", ln.Addr())
+
+	relay := &transport.Relay{Upstream: c.Upstream, Logf: logger.Verbosef}
+	if c.Mode == "tcp" {
+		return relay.ServeStream(ln)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(c.Path, relay.WebSocketHandler())
+	srv := &http.Server{Handler: mux}
+	if c.TLSCert != "" {
+		return srv.ServeTLS(ln, c.TLSCert, c.TLSKey)
+	}
+	return srv.Serve(ln)
+}
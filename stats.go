@@ -7,49 +7,85 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"golang.zx2c4.com/wireguard/device"
+
+	"github.com/zhsj/wghttp/internal/proxy"
 )
 
-func stats(dev *device.Device) func() (any, error) {
+type statsT struct {
+	Endpoint               string
+	LastHandshakeTimestamp int64
+	ReceivedBytes          int64
+	SentBytes              int64
+	WatchdogRecoveries     int64
+
+	ActiveConnections int64
+	TotalConnections  int64
+	DNSLookups        int64
+	DNSHostsHits      int64
+	DNSFailures       int64
+
+	RejectedByGlobalLimit int64
+	RejectedByClientLimit int64
+	Throttling            int64
+	ThrottleWaits         int64
+
+	NumGoroutine int
+	Version      string
+}
+
+func stats(dev *device.Device, peer *peer, proxier *proxy.Proxy) func() (any, error) {
 	return func() (any, error) {
-		var buf bytes.Buffer
-		if err := dev.IpcGetOperation(&buf); err != nil {
-			logger.Errorf("Get device config: %v", err)
-			return nil, err
-		}
+		return proxyStats(dev, peer, proxier)
+	}
+}
 
-		stats := struct {
-			Endpoint               string
-			LastHandshakeTimestamp int64
-			ReceivedBytes          int64
-			SentBytes              int64
-
-			NumGoroutine int
-			Version      string
-		}{
-			NumGoroutine: runtime.NumGoroutine(),
-			Version:      version(),
-		}
+func proxyStats(dev *device.Device, peer *peer, proxier *proxy.Proxy) (*statsT, error) {
+	stats, err := deviceStats(dev, peer)
+	if err != nil {
+		return nil, err
+	}
+	c := proxier.Counters()
+	stats.ActiveConnections, stats.TotalConnections = c.ActiveConnections, c.TotalConnections
+	stats.DNSLookups, stats.DNSHostsHits, stats.DNSFailures = c.DNSLookups, c.DNSHostsHits, c.DNSFailures
+	stats.RejectedByGlobalLimit, stats.RejectedByClientLimit = c.RejectedByGlobalLimit, c.RejectedByClientLimit
+	stats.Throttling, stats.ThrottleWaits = c.Throttling, c.ThrottleWaits
+	return stats, nil
+}
+
+func deviceStats(dev *device.Device, peer *peer) (*statsT, error) {
+	var buf bytes.Buffer
+	if err := dev.IpcGetOperation(&buf); err != nil {
+		logger.Errorf("Get device config: %v", err)
+		return nil, err
+	}
+
+	stats := &statsT{
+		WatchdogRecoveries: atomic.LoadInt64(&peer.recoveries),
 
-		scanner := bufio.NewScanner(&buf)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if prefix := "endpoint="; strings.HasPrefix(line, prefix) {
-				stats.Endpoint = strings.TrimPrefix(line, prefix)
-			}
-			if prefix := "last_handshake_time_sec="; strings.HasPrefix(line, prefix) {
-				stats.LastHandshakeTimestamp, _ = strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
-			}
-			if prefix := "rx_bytes="; strings.HasPrefix(line, prefix) {
-				stats.ReceivedBytes, _ = strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
-			}
-			if prefix := "tx_bytes="; strings.HasPrefix(line, prefix) {
-				stats.SentBytes, _ = strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
-			}
+		NumGoroutine: runtime.NumGoroutine(),
+		Version:      version(),
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if prefix := "endpoint="; strings.HasPrefix(line, prefix) {
+			stats.Endpoint = strings.TrimPrefix(line, prefix)
+		}
+		if prefix := "last_handshake_time_sec="; strings.HasPrefix(line, prefix) {
+			stats.LastHandshakeTimestamp, _ = strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
+		}
+		if prefix := "rx_bytes="; strings.HasPrefix(line, prefix) {
+			stats.ReceivedBytes, _ = strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
+		}
+		if prefix := "tx_bytes="; strings.HasPrefix(line, prefix) {
+			stats.SentBytes, _ = strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
 		}
-		return stats, nil
 	}
+	return stats, nil
 }
 
 func version() string {
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type statusCommand struct {
+	JSON  bool  `long:"json" description:"Print stats as JSON"`
+	Watch timeT `long:"watch" description:"Refresh the summary at this interval (format: 2s), 0 means print once"`
+}
+
+// statusClient fetches stats from the admin server of a running instance, or
+// from /stats of its HTTP proxy if there's no admin server.
+type statusClient struct {
+	client *http.Client
+	url    string
+}
+
+func newStatusClient() *statusClient {
+	addr, path := opts.AdminListen, "/stats"
+	if addr == "" {
+		addr = opts.Listen
+	}
+	network := "tcp"
+	if p := strings.TrimPrefix(addr, "unix:"); p != addr || strings.HasPrefix(addr, "/") {
+		network, addr = "unix", p
+	}
+	d := net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	host := "localhost"
+	if network == "tcp" {
+		host = addr
+	}
+	return &statusClient{
+		client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		url:    "http://" + host + path,
+	}
+}
+
+func (c *statusClient) fetch() (*statsT, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.AdminListen != "" && opts.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+string(opts.AdminToken))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	s := &statsT{}
+	if err := json.Unmarshal(body, s); err != nil {
+		return nil, fmt.Errorf("decode stats: %w", err)
+	}
+	return s, nil
+}
+
+func (c *statusCommand) Execute(args []string) error {
+	client := newStatusClient()
+	interval := time.Duration(c.Watch) * time.Second
+
+	prev, err := client.fetch()
+	if err != nil {
+		return err
+	}
+	prevTime := time.Now()
+	if c.JSON && interval == 0 {
+		return printJSON(prev)
+	}
+	// Rates need two samples.
+	if interval == 0 {
+		time.Sleep(time.Second)
+	}
+	for {
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+		cur, err := client.fetch()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if c.JSON {
+			if err := printJSON(cur); err != nil {
+				return err
+			}
+		} else {
+			if interval > 0 {
+				// Clear the screen.
+				fmt.Print("\033[H\033[2J")
+			}
+			printStatus(os.Stdout, prev, cur, now.Sub(prevTime))
+		}
+		if interval == 0 {
+			return nil
+		}
+		prev, prevTime = cur, now
+	}
+}
+
+func printJSON(s *statsT) error {
+	resp, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(resp))
+	return nil
+}
+
+func printStatus(w io.Writer, prev, cur *statsT, elapsed time.Duration) {
+	handshake := "never"
+	if cur.LastHandshakeTimestamp > 0 {
+		age := time.Since(time.Unix(cur.LastHandshakeTimestamp, 0)).Truncate(time.Second)
+		handshake = fmt.Sprintf("%s ago", age)
+		if age > handshakeHealthy {
+			handshake += " (stale)"
+		}
+	}
+	rate := func(prev, cur int64) string {
+		return formatBytes(float64(cur-prev)/elapsed.Seconds()) + "/s"
+	}
+	endpoint := cur.Endpoint
+	if endpoint == "" {
+		endpoint = "(none)"
+	}
+
+	fmt.Fprintf(w, "version:     %s\n", cur.Version)
+	fmt.Fprintf(w, "endpoint:    %s\n", endpoint)
+	fmt.Fprintf(w, "handshake:   %s\n", handshake)
+	fmt.Fprintf(w, "transfer:    %s received (%s), %s sent (%s)\n",
+		formatBytes(float64(cur.ReceivedBytes)), rate(prev.ReceivedBytes, cur.ReceivedBytes),
+		formatBytes(float64(cur.SentBytes)), rate(prev.SentBytes, cur.SentBytes))
+	fmt.Fprintf(w, "connections: %d active, %d total, %d rejected by global limit, %d by client limit\n",
+		cur.ActiveConnections, cur.TotalConnections, cur.RejectedByGlobalLimit, cur.RejectedByClientLimit)
+	fmt.Fprintf(w, "dns:         %d lookups, %d answered by static hosts, %d failures\n",
+		cur.DNSLookups, cur.DNSHostsHits, cur.DNSFailures)
+	fmt.Fprintf(w, "recoveries:  %d\n", cur.WatchdogRecoveries)
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 3 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", n/unit, "KMGT"[exp])
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+
+	"github.com/zhsj/wghttp/internal/proxy"
+	"github.com/zhsj/wghttp/internal/systemd"
+)
+
+// statusInterval is how often the status is sent to systemd.
+const statusInterval = 10 * time.Second
+
+func notify(state string) bool {
+	ok, err := systemd.Notify(state)
+	if err != nil {
+		logger.Errorf("Notify systemd: %v", err)
+	}
+	return ok
+}
+
+// notifySystemd tells systemd that wghttp is ready, either now or after the
+// first handshake, then keeps updating the status and pinging the watchdog.
+func notifySystemd(dev *device.Device, peer *peer, proxier *proxy.Proxy) {
+	ready := !opts.NotifyHandshake
+	state := "STATUS=Waiting for handshake"
+	if ready {
+		state = "READY=1\n" + state
+	}
+	if !notify(state) {
+		return
+	}
+
+	var watchdogC <-chan time.Time
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		watchdogC = time.Tick(interval)
+	}
+	// Check the handshake more often before being ready.
+	statusC := time.Tick(time.Second)
+	if ready {
+		statusC = time.Tick(statusInterval)
+	}
+
+	for {
+		select {
+		case <-watchdogC:
+			notify("WATCHDOG=1")
+			continue
+		case <-statusC:
+		}
+		s, err := proxyStats(dev, peer, proxier)
+		if err != nil {
+			continue
+		}
+		state := "STATUS=" + statusLine(s)
+		if !ready && s.LastHandshakeTimestamp > 0 {
+			ready = true
+			state = "READY=1\n" + state
+			statusC = time.Tick(statusInterval)
+		}
+		notify(state)
+	}
+}
+
+func statusLine(s *statsT) string {
+	handshake := "No handshake yet"
+	if s.LastHandshakeTimestamp > 0 {
+		age := time.Since(time.Unix(s.LastHandshakeTimestamp, 0)).Truncate(time.Second)
+		handshake = fmt.Sprintf("Handshake %s ago", age)
+	}
+	return fmt.Sprintf("%s with %s, %d active connections", handshake, s.Endpoint, s.ActiveConnections)
+}
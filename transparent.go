@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+
+	"github.com/zhsj/wghttp/internal/proxy"
+	"github.com/zhsj/wghttp/internal/sniff"
+	"github.com/zhsj/wghttp/internal/transparent"
+)
+
+// serveTransparent proxies connections redirected to --transparent-listen,
+// sending errors of serving to errc. UDP packets are relayed by the returned
+// UDPRelay in tproxy mode, which is nil otherwise.
+func serveTransparent(tnet *netstack.Net, proxier *proxy.Proxy, errc chan<- error) (*transparent.UDPRelay, error) {
+	if opts.ExitMode != "remote" {
+		return nil, errors.New("transparent proxy is only supported in remote exit mode")
+	}
+	mode := transparent.Mode(opts.TransparentMode)
+
+	ln, err := transparent.Listen(opts.TransparentListen, mode)
+	if err != nil {
+		return nil, fmt.Errorf("create transparent listener: %w", err)
+	}
+	logger.Verbosef("Transparent proxy listening on %s in %s mode", ln.Addr(), mode)
+
+	var relay *transparent.UDPRelay
+	if mode == transparent.TProxy {
+		pc, err := transparent.ListenUDP(opts.TransparentListen)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("create transparent UDP listener: %w", err)
+		}
+		relay = &transparent.UDPRelay{Dial: tnet.DialContext, Logf: logger.Verbosef}
+		go func() {
+			if err := relay.Serve(pc); !errors.Is(err, net.ErrClosed) {
+				errc <- err
+			}
+		}()
+	}
+
+	go func() {
+		target := func(c net.Conn) (string, net.Conn, error) {
+			addr, err := transparent.OriginalDst(c, mode)
+			return addr, c, err
+		}
+		errc <- proxier.ServeForward(ln, target, logger.Verbosef)
+	}()
+	return relay, nil
+}
+
+// serveSniff forwards TLS and HTTP connections to --sniff-listen by their
+// server names, sending errors of serving to errc.
+func serveSniff(tnet *netstack.Net, proxier *proxy.Proxy, errc chan<- error) error {
+	for _, addr := range opts.SniffListen {
+		var ln net.Listener
+		switch opts.ExitMode {
+		case "local":
+			tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("resolve sniff listen addr: %w", err)
+			}
+			ln, err = tnet.ListenTCP(tcpAddr)
+			if err != nil {
+				return fmt.Errorf("create sniff listener on netstack: %w", err)
+			}
+		case "remote":
+			var err error
+			ln, err = net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("create sniff listener on local net: %w", err)
+			}
+		}
+		// Forwarded connections aren't authenticated, so they can't be
+		// open to others when the proxy is.
+		tcpAddr, _ := ln.Addr().(*net.TCPAddr)
+		if len(opts.ProxyUsers) > 0 && len(opts.SniffAllow) == 0 && (tcpAddr == nil || !tcpAddr.IP.IsLoopback()) {
+			ln.Close()
+			return fmt.Errorf("--sniff-listen %s isn't covered by --proxy-user, set --sniff-allow for its destinations", addr)
+		}
+		logger.Verbosef("Sniffing TLS and HTTP on %s", ln.Addr())
+
+		target := sniffTarget(ln.Addr(), opts.SniffAllow)
+		go func() {
+			errc <- proxier.ServeForward(ln, target, logger.Verbosef)
+		}()
+	}
+	return nil
+}
+
+// sniffTarget returns the target of connections accepted on addr, which is
+// the same port of their server names. Server names must match one of allow,
+// if it's not empty.
+func sniffTarget(addr net.Addr, allow []string) func(c net.Conn) (string, net.Conn, error) {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return func(c net.Conn) (string, net.Conn, error) {
+		host, src, err := sniff.Host(c)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(allow) == 0 {
+			return net.JoinHostPort(host, port), src, nil
+		}
+		for _, pattern := range allow {
+			if proxy.MatchHost(pattern, host) {
+				return net.JoinHostPort(host, port), src, nil
+			}
+		}
+		return "", nil, fmt.Errorf("%s isn't allowed by --sniff-allow", host)
+	}
+}
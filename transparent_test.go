@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSniffTarget(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	for _, tt := range []struct {
+		name  string
+		host  string
+		allow []string
+		want  string
+	}{
+		{"port of listener", "example.com", nil, "example.com:443"},
+		{"port in host ignored", "example.com:22", nil, "example.com:443"},
+		{"allowed subdomain", "www.example.com", []string{"example.com"}, "www.example.com:443"},
+		{"allowed ip", "10.1.2.3", []string{"example.com", "10.0.0.0/8"}, "10.1.2.3:443"},
+		{"not allowed", "example.org", []string{"example.com"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", tt.host)
+
+			got, _, err := sniffTarget(addr, tt.allow)(server)
+			if (err != nil) != (tt.want == "") || got != tt.want {
+				t.Errorf("target = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
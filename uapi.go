@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// serveUAPI serves the WireGuard UAPI on a Unix socket, so wg(8) can
+// inspect and configure the device.
+func serveUAPI(dev *device.Device) error {
+	if err := removeStaleSocket(opts.UAPISocket); err != nil {
+		return err
+	}
+	ln, err := net.Listen("unix", opts.UAPISocket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(opts.UAPISocket, 0o600); err != nil {
+		ln.Close()
+		return fmt.Errorf("chmod socket: %w", err)
+	}
+	logger.Verbosef("UAPI listening on %s", ln.Addr())
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				logger.Errorf("Serve UAPI: %v", err)
+				return
+			}
+			if opts.UAPIReadOnly {
+				go handleReadOnlyUAPI(dev, c)
+			} else {
+				go dev.IpcHandle(c)
+			}
+		}
+	}()
+	return nil
+}
+
+// handleReadOnlyUAPI is like device.IpcHandle, but rejects set operations.
+func handleReadOnlyUAPI(dev *device.Device, c net.Conn) {
+	defer c.Close()
+	buffered := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+
+	for {
+		op, err := buffered.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		errno := 0
+		switch op {
+		case "get=1\n":
+			if next, err := buffered.ReadString('\n'); err != nil || next != "\n" {
+				return
+			}
+			if err := dev.IpcGetOperation(buffered); err != nil {
+				logger.Errorf("UAPI get: %v", err)
+				errno = int(syscall.EIO)
+			}
+		case "set=1\n":
+			// Drain the config, which ends with an empty line.
+			for {
+				line, err := buffered.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimSpace(line) == "" {
+					break
+				}
+			}
+			logger.Errorf("UAPI set is rejected in read-only mode")
+			errno = int(syscall.EPERM)
+		default:
+			logger.Errorf("Invalid UAPI operation: %q", op)
+			return
+		}
+
+		fmt.Fprintf(buffered, "errno=%d\n\n", errno)
+		if err := buffered.Flush(); err != nil {
+			return
+		}
+	}
+}